@@ -0,0 +1,143 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/docker/engine-api/client"
+)
+
+// Targets are connected to their onion network with a network alias, so that
+// the torrc can refer to the target by a name which survives the target being
+// restarted or recreated with a new address. Tor only accepts IP addresses (or
+// unix sockets) in HiddenServicePort, so the Tor image runs Tor through an
+// entrypoint which resolves the aliases in the torrc before starting Tor, and
+// again every time Tor is reloaded with SIGHUP.
+//
+// Images which don't have the entrypoint (such as images passed with -image)
+// don't have the LabelResolve label, so their torrc uses IP addresses.
+
+const (
+	// EntrypointPath is where the entrypoint lives in the Tor image.
+	EntrypointPath = "/usr/local/bin/mkonion-tor"
+
+	// Entrypoint is the entrypoint of the Tor image. It copies TorrcPath to a
+	// resolved torrc with every alias in a HiddenServicePort line replaced by
+	// its address. Resolving is retried for a while, since the Tor container
+	// is started before it is connected to the onion network. With
+	// --verify-config it only checks the (resolved) torrc.
+	Entrypoint = `#!/bin/sh
+# mkonion-tor: run tor after resolving target aliases in the torrc.
+set -f
+
+TORRC=/etc/tor/torrc
+RESOLVED=/run/mkonion/torrc
+
+lookup() {
+	i=0
+	while [ "$i" -lt 30 ]; do
+		addr="$(getent hosts "$1" | awk '{ print $1; exit }')"
+		if [ -n "$addr" ]; then
+			case "$addr" in
+			*:*) echo "[$addr]" ;;
+			*) echo "$addr" ;;
+			esac
+			return 0
+		fi
+		i=$((i + 1))
+		sleep 1
+	done
+	echo "mkonion-tor: cannot resolve $1" >&2
+	return 1
+}
+
+resolve() {
+	mkdir -p "$(dirname "$out")" || return 1
+	: >"$out.tmp" || return 1
+	while IFS= read -r line; do
+		set -- $line
+		if [ "$1" = HiddenServicePort ] && [ "$#" -eq 3 ]; then
+			host="${3%:*}"
+			case "$host" in
+			unix|\[*) ;;
+			*[!0-9.]*)
+				addr="$(lookup "$host")" || return 1
+				line="$1 $2 $addr:${3##*:}"
+				;;
+			esac
+		fi
+		printf '%s\n' "$line" >>"$out.tmp"
+	done <"$TORRC"
+	mv "$out.tmp" "$out"
+}
+
+if [ "$1" = "--verify-config" ]; then
+	out="$RESOLVED.verify"
+	resolve || exit 1
+	exec tor --verify-config -f "$out"
+fi
+
+out="$RESOLVED"
+resolve || exit 1
+tor -f "$RESOLVED" &
+pid=$!
+
+trap 'resolve && kill -HUP "$pid"' HUP
+trap 'kill -TERM "$pid"' TERM INT
+
+# wait returns early whenever a trapped signal arrives.
+while kill -0 "$pid" 2>/dev/null; do
+	wait "$pid"
+	status=$?
+done
+exit "$status"
+`
+)
+
+// targetAlias returns the alias of the target on the given onion network.
+// Underscores aren't valid in hostnames, so they are replaced with hyphens.
+func targetAlias(ident string) string {
+	return strings.Replace(ident, "_", "-", -1)
+}
+
+// imageResolvesAliases returns whether the entrypoint of the given Tor image
+// resolves target aliases.
+func imageResolvesAliases(cli *client.Client, imageID string) (bool, error) {
+	inspect, _, err := cli.ImageInspectWithRaw(imageID, false)
+	if err != nil {
+		return false, err
+	}
+	if inspect.Config == nil {
+		return false, nil
+	}
+	return inspect.Config.Labels[LabelResolve] == "true", nil
+}
+
+// usesAliases returns whether any of the hidden services in a torrc forward to
+// an alias rather than an address.
+func usesAliases(services []TorService) bool {
+	for _, svc := range services {
+		for _, target := range svc.Targets {
+			if net.ParseIP(target.Addr) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyConfigCommand returns the command which checks the torrc of a Tor
+// container. A torrc with aliases can only be checked once they are resolved.
+func verifyConfigCommand(services []TorService) []string {
+	if usesAliases(services) {
+		return []string{EntrypointPath, "--verify-config"}
+	}
+	return []string{"tor", "--verify-config", "-f", TorrcPath}
+}
@@ -0,0 +1,364 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"gopkg.in/yaml.v2"
+)
+
+// `mkonion apply` reads a file declaring a set of onion services, and then
+// creates, recreates or removes onion services until the labelled resources on
+// the daemon match the file. Every service created by apply is labelled with a
+// hash of its spec, which is how we tell whether a service is up to date and
+// which services are managed by apply (and can thus be removed).
+
+// ImageSpec is the declarative form of ImageOptions.
+type ImageSpec struct {
+	Image      string `yaml:"image" json:"image,omitempty"`
+	Dockerfile string `yaml:"dockerfile" json:"dockerfile,omitempty"`
+	BaseImage  string `yaml:"base_image" json:"base_image,omitempty"`
+	TorVersion string `yaml:"tor_version" json:"tor_version,omitempty"`
+}
+
+// ServiceSpec declares a single onion service.
+type ServiceSpec struct {
+	Target     string            `yaml:"target" json:"target"`
+	Name       string            `yaml:"name" json:"name,omitempty"`
+	Ports      []string          `yaml:"ports" json:"ports,omitempty"`
+	Key        string            `yaml:"key" json:"key,omitempty"`
+	Persist    bool              `yaml:"persist" json:"persist,omitempty"`
+	Shared     bool              `yaml:"shared" json:"shared,omitempty"`
+	Isolate    bool              `yaml:"isolate" json:"isolate,omitempty"`
+	OnionCat   bool              `yaml:"onioncat" json:"onioncat,omitempty"`
+	Network    string            `yaml:"network" json:"network,omitempty"`
+	Clients    map[string]string `yaml:"clients" json:"clients,omitempty"`
+	TorOptions map[string]string `yaml:"tor_options" json:"tor_options,omitempty"`
+}
+
+// OnionsFile is the top-level structure of an onions.yml file.
+type OnionsFile struct {
+	Image    ImageSpec     `yaml:"image"`
+	Services []ServiceSpec `yaml:"services"`
+}
+
+// LoadOnionsFile reads and validates an onions.yml file. Relative paths in
+// the file are relative to the directory containing the file.
+func LoadOnionsFile(path string) (*OnionsFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file OnionsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(filepath.Dir(path), p)
+	}
+
+	file.Image.Dockerfile = resolve(file.Image.Dockerfile)
+	if err := file.Image.Options().Validate(); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for i := range file.Services {
+		spec := &file.Services[i]
+		if spec.Target == "" {
+			return nil, fmt.Errorf("service %d: must specify a target", i)
+		}
+		if seen[spec.Target] {
+			return nil, fmt.Errorf("service %s: declared more than once", spec.Target)
+		}
+		seen[spec.Target] = true
+
+		if err := ValidateMappings(spec.Ports); err != nil {
+			return nil, fmt.Errorf("service %s: %s", spec.Target, err)
+		}
+		if err := ValidateTorOptions(spec.TorOptions); err != nil {
+			return nil, fmt.Errorf("service %s: %s", spec.Target, err)
+		}
+		spec.Key = resolve(spec.Key)
+	}
+
+	return &file, nil
+}
+
+// Options converts the spec into ImageOptions.
+func (spec ImageSpec) Options() *ImageOptions {
+	return &ImageOptions{
+		Image:      spec.Image,
+		Dockerfile: spec.Dockerfile,
+		BaseImage:  spec.BaseImage,
+		TorVersion: spec.TorVersion,
+	}
+}
+
+// plannedService is a service spec resolved against the daemon.
+type plannedService struct {
+	spec       *ServiceSpec
+	key        *OnionKey
+	targetName string
+	hash       string
+}
+
+// hashSpec computes the hash stored in the LabelSpec label. It covers
+// everything that affects the resulting service, including the onion address
+// of the key rather than its path.
+func hashSpec(image ImageSpec, spec *ServiceSpec, key *OnionKey) (string, error) {
+	var onion string
+	if key != nil {
+		onion = key.Hostname()
+	}
+
+	// encoding/json sorts map keys, so this is deterministic.
+	data, err := json.Marshal(struct {
+		Image   ImageSpec    `json:"image"`
+		Service *ServiceSpec `json:"service"`
+		Onion   string       `json:"onion,omitempty"`
+	}{
+		Image:   image,
+		Service: spec,
+		Onion:   onion,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])[:16], nil
+}
+
+func planService(cli *client.Client, image ImageSpec, spec *ServiceSpec) (*plannedService, error) {
+	target, err := cli.ContainerInspect(spec.Target)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting target: %s", err)
+	}
+
+	var key *OnionKey
+	if spec.Key != "" {
+		key, err = LoadOnionKey(spec.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hash, err := hashSpec(image, spec, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &plannedService{
+		spec:       spec,
+		key:        key,
+		targetName: strings.TrimPrefix(target.Name, "/"),
+		hash:       hash,
+	}, nil
+}
+
+// createSpec creates the onion service declared by a spec, which replaces the
+// given outdated onion services of the target. They are only removed once the
+// new onion service is up, so it can't use the same name as one of them.
+func createSpec(cli *client.Client, image ImageSpec, plan *plannedService, outdated []*OnionService) bool {
+	spec := plan.spec
+	logger := log.WithField("target", spec.Target)
+
+	if spec.Name != "" {
+		ident, err := NameIdentifier(spec.Name)
+		if err != nil {
+			logger.Errorf("apply: %s", err)
+			return false
+		}
+		for _, svc := range outdated {
+			if svc.Ident == ident {
+				logger.Errorf("apply: outdated onion service %s has to be removed (with `mkonion rm`) before it can be replaced, as the replacement has the same name", svc.Ident)
+				return false
+			}
+		}
+	}
+
+	if !spec.Persist && plan.key == nil && len(outdated) > 0 {
+		logger.Warn("apply: service has no key or persistent volume, so it will get a new onion address")
+	}
+
+	logger.Info("apply: creating onion service")
+	result, err := CreateOnionService(cli, &CreateOptions{
+		Target:         spec.Target,
+		Name:           spec.Name,
+		Mappings:       spec.Ports,
+		Key:            plan.key,
+		Persist:        spec.Persist,
+		Shared:         spec.Shared,
+		Isolate:        spec.Isolate,
+		OnionCat:       spec.OnionCat,
+		NetworkName:    spec.Network,
+		PublishTimeout: DefaultPublishTimeout,
+		Image:          image.Options(),
+		Clients:        spec.Clients,
+		TorOptions:     spec.TorOptions,
+		Replaces:       outdated,
+		Spec:           plan.hash,
+	})
+	if err != nil {
+		logger.Errorf("apply: creating onion service: %s", err)
+		return false
+	}
+	logger.WithFields(log.Fields{
+		"ident": result.Ident,
+		"onion": result.Onion,
+	}).Info("apply: created onion service")
+	return true
+}
+
+// Apply reconciles the onion services on the daemon with the given file.
+func Apply(cli *client.Client, file *OnionsFile) error {
+	svcs, err := FindOnionServices(cli)
+	if err != nil {
+		return fmt.Errorf("finding onion services: %s", err)
+	}
+
+	// Only services with a spec label are managed by apply. We never touch
+	// anything else.
+	managed := map[string][]*OnionService{}
+	unmanaged := map[string]bool{}
+	for _, svc := range svcs {
+		if svc.Labels == nil {
+			continue
+		}
+		if svc.Labels.Spec == "" {
+			unmanaged[svc.Labels.TargetName] = true
+			continue
+		}
+		managed[svc.Labels.TargetName] = append(managed[svc.Labels.TargetName], svc)
+	}
+
+	// If a spec can't be planned we don't know for sure which target it
+	// declares (it might be given by ID), so nothing undeclared is removed.
+	var failed, unplanned bool
+	declared := map[string]bool{}
+	for i := range file.Services {
+		spec := &file.Services[i]
+		logger := log.WithField("target", spec.Target)
+		declared[strings.TrimPrefix(spec.Target, "/")] = true
+
+		plan, err := planService(cli, file.Image, spec)
+		if err != nil {
+			logger.Errorf("apply: %s", err)
+			failed, unplanned = true, true
+			continue
+		}
+		declared[plan.targetName] = true
+
+		if unmanaged[plan.targetName] {
+			logger.Warn("apply: target already has an onion service not managed by apply, skipping it")
+			continue
+		}
+
+		// Anything that doesn't match the current spec has to be replaced,
+		// including services whose ports were changed by `mkonion update`.
+		var upToDate *OnionService
+		var outdated []*OnionService
+		for _, svc := range managed[plan.targetName] {
+			if svc.Labels.Spec == plan.hash && !svc.Updated && upToDate == nil {
+				upToDate = svc
+				continue
+			}
+			outdated = append(outdated, svc)
+		}
+
+		if upToDate != nil {
+			logger.Info("apply: onion service is up to date")
+		} else if !createSpec(cli, file.Image, plan, outdated) {
+			// Keep the outdated services, rather than leaving the target
+			// without any onion service.
+			failed = true
+			continue
+		}
+
+		for _, svc := range outdated {
+			// If the replacement isolates the target, it has taken over the
+			// networks the target was isolated from.
+			if spec.Isolate && svc.Labels.Isolate {
+				svc.Labels.IsolatedFrom = nil
+			}
+
+			logger.WithField("ident", svc.Ident).Info("apply: removing outdated onion service")
+			if err := RemoveOnionService(cli, svc, false); err != nil {
+				logger.Errorf("apply: removing %s: %s", svc.Ident, err)
+				failed = true
+			}
+		}
+	}
+
+	// Remove managed services whose targets are no longer declared.
+	if unplanned {
+		log.Warn("apply: not removing undeclared onion services, as some services could not be planned")
+		managed = nil
+	}
+	for targetName, svcs := range managed {
+		if declared[targetName] {
+			continue
+		}
+
+		for _, svc := range svcs {
+			log.WithFields(log.Fields{
+				"target": targetName,
+				"ident":  svc.Ident,
+			}).Info("apply: removing undeclared onion service")
+			if err := RemoveOnionService(cli, svc, false); err != nil {
+				log.Errorf("apply: removing %s: %s", svc.Ident, err)
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("failed to apply some onion services")
+	}
+	return nil
+}
+
+func cmdApply(args []string) error {
+	var oFile string
+
+	flags := newFlagSet("apply", "-f <onions.yml>")
+	flags.StringVar(&oFile, "f", "", "file declaring the onion services")
+	flags.Parse(args)
+
+	if oFile == "" || flags.NArg() != 0 {
+		flags.Usage()
+		return fmt.Errorf("must specify a file with -f")
+	}
+
+	file, err := LoadOnionsFile(oFile)
+	if err != nil {
+		return err
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	return Apply(cli, file)
+}
@@ -0,0 +1,418 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cyphar/mkonion/buildctx"
+	"github.com/docker/engine-api/client"
+)
+
+// Version 3 onion services support client authorization. If the
+// authorized_clients directory of a service contains any <name>.auth files,
+// only clients holding the x25519 private key corresponding to one of them can
+// access the service. See the "CLIENT AUTHORIZATION" section of tor(1).
+//
+// Clients are managed with `mkonion auth`, which modifies the authorized_clients
+// directory inside the Tor container and then reloads Tor with SIGHUP, so the
+// onion service (and its address) stay up.
+
+const (
+	AuthorizedClientsDir = "authorized_clients"
+	authFileSuffix       = ".auth"
+)
+
+var clientNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// decodeX25519Key decodes a base32-encoded x25519 key, in the form Tor uses
+// in .auth and .auth_private files.
+func decodeX25519Key(encoded string) ([]byte, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(encoded, "=")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base32 x25519 key: %s", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("x25519 key has wrong length: expected 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// encodeX25519Key encodes an x25519 key in the form Tor uses in .auth and
+// .auth_private files.
+func encodeX25519Key(key []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+}
+
+// AuthorizedClientFile returns the contents of the .auth file for a client
+// with the given (base32-encoded) x25519 public key.
+func AuthorizedClientFile(name, public string) ([]byte, error) {
+	if !clientNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid client name '%s': must only contain [a-zA-Z0-9_-]", name)
+	}
+
+	key, err := decodeX25519Key(public)
+	if err != nil {
+		return nil, fmt.Errorf("client %s: %s", name, err)
+	}
+
+	return []byte("descriptor:x25519:" + encodeX25519Key(key) + "\n"), nil
+}
+
+// authorizedClientFiles returns the set of .auth files for the given clients,
+// relative to the hidden_service directory.
+func authorizedClientFiles(clients map[string]string) ([]*buildctx.Entry, error) {
+	files := []*buildctx.Entry{{
+		Path: AuthorizedClientsDir,
+		Mode: os.ModeDir | 0700,
+	}}
+	for name, public := range clients {
+		data, err := AuthorizedClientFile(name, public)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, &buildctx.Entry{
+			Path: path.Join(AuthorizedClientsDir, name+authFileSuffix),
+			Mode: 0600,
+			Data: data,
+		})
+	}
+	return files, nil
+}
+
+// ClientKey is an x25519 keypair used for client authorization.
+type ClientKey struct {
+	Private []byte
+	Public  []byte
+}
+
+// GenerateClientKey generates a new x25519 keypair for client authorization.
+func GenerateClientKey(r io.Reader) (*ClientKey, error) {
+	priv, err := ecdh.X25519().GenerateKey(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClientKey{
+		Private: priv.Bytes(),
+		Public:  priv.PublicKey().Bytes(),
+	}, nil
+}
+
+// AuthPrivateLine returns the line of the client's .auth_private file (in the
+// ClientOnionAuthDir of the client) for accessing the given onion service.
+func (key *ClientKey) AuthPrivateLine(onion string) string {
+	return strings.TrimSuffix(onion, ".onion") + ":descriptor:x25519:" + encodeX25519Key(key.Private)
+}
+
+// clientServiceDir returns the path (inside the Tor container) of the directory
+// of the given onion service, along with its onion address. name selects one of
+// several named onion services.
+func clientServiceDir(svc *OnionService, name string) (string, string, error) {
+	if svc.Labels != nil && svc.Labels.Ephemeral {
+		return "", "", fmt.Errorf("onion service %s is ephemeral, its clients can only be changed by recreating it", svc.Ident)
+	}
+
+	if svc.Labels != nil && svc.Labels.Daemon != "" {
+		return path.Join(HiddenServiceDir, svc.Ident), svc.Onion, nil
+	}
+
+	if len(svc.Services) > 0 {
+		if name == "" {
+			return "", "", fmt.Errorf("onion service %s has several services, specify one with -service", svc.Ident)
+		}
+		onion, ok := svc.Services[name]
+		if !ok {
+			return "", "", fmt.Errorf("onion service %s has no service named '%s'", svc.Ident, name)
+		}
+		return path.Join(HiddenServiceDir, name), onion, nil
+	}
+
+	if name != "" {
+		return "", "", fmt.Errorf("onion service %s has no named services", svc.Ident)
+	}
+	return HiddenServiceDir, svc.Onion, nil
+}
+
+// ListAuthorizedClients returns the authorized clients of an onion service,
+// as a map from client names to base32-encoded x25519 public keys.
+func ListAuthorizedClients(cli *client.Client, containerID, dir string) (map[string]string, error) {
+	clients := map[string]string{}
+
+	content, _, err := cli.CopyFromContainer(containerID, path.Join(dir, AuthorizedClientsDir))
+	if err != nil {
+		// No directory means no clients.
+		if strings.Contains(err.Error(), "no such file or directory") {
+			return clients, nil
+		}
+		return nil, err
+	}
+	defer content.Close()
+
+	tr := tar.NewReader(content)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Base(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(name, authFileSuffix) {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		// The file is of the form descriptor:x25519:<public key>.
+		fields := strings.Split(strings.TrimSpace(string(data)), ":")
+		if len(fields) != 3 || fields[0] != "descriptor" || fields[1] != "x25519" {
+			log.Warnf("ignoring invalid client authorization file %s", name)
+			continue
+		}
+		clients[strings.TrimSuffix(name, authFileSuffix)] = fields[2]
+	}
+
+	return clients, nil
+}
+
+// reloadTor makes Tor re-read its configuration and onion service
+// directories. If the container isn't running, the changes will be picked up
+// when it starts.
+func reloadTor(cli *client.Client, containerID string) error {
+	inspect, err := cli.ContainerInspect(containerID)
+	if err != nil {
+		return err
+	}
+	if !isRunning(inspect.State) {
+		log.Warnf("tor container %s is not running, changes will apply when it starts", containerID)
+		return nil
+	}
+
+	log.Infof("reloading tor in container %s", containerID)
+	return cli.ContainerKill(containerID, "HUP")
+}
+
+func cmdAuth(args []string) error {
+	subcommands := map[string]func(args []string) error{
+		"add":    cmdAuthAdd,
+		"remove": cmdAuthRemove,
+		"list":   cmdAuthList,
+	}
+
+	if len(args) == 0 || subcommands[args[0]] == nil {
+		fmt.Fprintf(os.Stderr, "usage: %s auth add [-service name] [-public-key key] <ident|target> <client>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s auth remove [-service name] <ident|target> <client>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s auth list [-service name] <ident|target>\n", os.Args[0])
+		return fmt.Errorf("must specify a valid auth subcommand")
+	}
+
+	return subcommands[args[0]](args[1:])
+}
+
+func cmdAuthAdd(args []string) error {
+	var oService, oPublicKey string
+
+	flags := newFlagSet("auth add", "[-service name] [-public-key key] <ident|target> <client>")
+	flags.StringVar(&oService, "service", "", "name of the service, for onion services created with -service")
+	flags.StringVar(&oPublicKey, "public-key", "", "use an existing base32-encoded x25519 public key rather than generating a keypair")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("must specify an onion service and a client name")
+	}
+	clientName := flags.Arg(1)
+
+	// Generate a keypair unless we were given the client's public key.
+	var key *ClientKey
+	if oPublicKey == "" {
+		var err error
+		key, err = GenerateClientKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("generating client key: %s", err)
+		}
+		oPublicKey = encodeX25519Key(key.Public)
+	}
+
+	files, err := authorizedClientFiles(map[string]string{clientName: oPublicKey})
+	if err != nil {
+		return err
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	svc, err := findSingleService(cli, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	dir, onion, err := clientServiceDir(svc, oService)
+	if err != nil {
+		return err
+	}
+	// The generated private key is only ever printed, so don't authorize the
+	// client unless we can print it.
+	if key != nil && onion == "" {
+		return fmt.Errorf("onion address of %s is not known yet, cannot print client key", svc.Ident)
+	}
+
+	clients, err := ListAuthorizedClients(cli, svc.ContainerID, dir)
+	if err != nil {
+		return fmt.Errorf("listing authorized clients: %s", err)
+	}
+	if _, ok := clients[clientName]; ok {
+		return fmt.Errorf("client %s is already authorized", clientName)
+	}
+	if len(clients) == 0 {
+		log.Warnf("onion service %s had no authorized clients, so it is now only accessible to authorized clients", svc.Ident)
+	}
+
+	if err := copyFilesToContainer(cli, svc.ContainerID, dir, files); err != nil {
+		return fmt.Errorf("copying client authorization: %s", err)
+	}
+	if err := reloadTor(cli, svc.ContainerID); err != nil {
+		return fmt.Errorf("reloading tor: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"ident":  svc.Ident,
+		"client": clientName,
+	}).Info("authorized client")
+
+	// The client needs this line in a .auth_private file in its
+	// ClientOnionAuthDir.
+	if key != nil {
+		fmt.Println(key.AuthPrivateLine(onion))
+	}
+	return nil
+}
+
+func cmdAuthRemove(args []string) error {
+	var oService string
+
+	flags := newFlagSet("auth remove", "[-service name] <ident|target> <client>")
+	flags.StringVar(&oService, "service", "", "name of the service, for onion services created with -service")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("must specify an onion service and a client name")
+	}
+	clientName := flags.Arg(1)
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	svc, err := findSingleService(cli, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	dir, _, err := clientServiceDir(svc, oService)
+	if err != nil {
+		return err
+	}
+
+	clients, err := ListAuthorizedClients(cli, svc.ContainerID, dir)
+	if err != nil {
+		return fmt.Errorf("listing authorized clients: %s", err)
+	}
+	if _, ok := clients[clientName]; !ok {
+		return fmt.Errorf("client %s is not authorized", clientName)
+	}
+	if len(clients) == 1 {
+		log.Warnf("removing the last authorized client of %s, so it is now accessible to everyone", svc.Ident)
+	}
+
+	// XXX: There's no API for removing files from a container, so we need the
+	//      container to be running.
+	file := path.Join(dir, AuthorizedClientsDir, clientName+authFileSuffix)
+	if err := execInContainer(cli, svc.ContainerID, []string{"rm", "-f", file}); err != nil {
+		return fmt.Errorf("removing client authorization: %s", err)
+	}
+	if err := reloadTor(cli, svc.ContainerID); err != nil {
+		return fmt.Errorf("reloading tor: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"ident":  svc.Ident,
+		"client": clientName,
+	}).Info("removed client authorization")
+	return nil
+}
+
+func cmdAuthList(args []string) error {
+	var oService string
+
+	flags := newFlagSet("auth list", "[-service name] <ident|target>")
+	flags.StringVar(&oService, "service", "", "name of the service, for onion services created with -service")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("must specify an onion service")
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	svc, err := findSingleService(cli, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	dir, _, err := clientServiceDir(svc, oService)
+	if err != nil {
+		return err
+	}
+
+	clients, err := ListAuthorizedClients(cli, svc.ContainerID, dir)
+	if err != nil {
+		return fmt.Errorf("listing authorized clients: %s", err)
+	}
+
+	var names []string
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tPUBLIC KEY")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, clients[name])
+	}
+	return w.Flush()
+}
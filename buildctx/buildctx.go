@@ -0,0 +1,258 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package buildctx creates tar archives (such as Docker build contexts, or the
+// content of a copy into a container) entirely in memory. Archives are
+// deterministic: entries are sorted by path and every header field is fixed,
+// so identical entries always produce byte-identical archives. This matters
+// for build contexts, since Docker's build cache takes the metadata of files
+// into account.
+package buildctx
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Epoch is the modification time of entries which don't specify one.
+var Epoch = time.Unix(0, 0).UTC()
+
+// Entry is a single regular file, directory or symlink in an archive. The type
+// of the entry is taken from Mode, and only the permission bits of Mode are
+// stored in the archive.
+type Entry struct {
+	// Path is the slash-separated path of the entry, relative to the root of
+	// the archive.
+	Path string
+	// Mode is the type and permissions of the entry.
+	Mode os.FileMode
+	// Data is the content of a regular file.
+	Data []byte
+	// Target is the target of a symlink.
+	Target string
+	// Uid and Gid are the numeric owner of the entry. No user or group names
+	// are stored, since they would depend on the host.
+	Uid int
+	Gid int
+	// ModTime is the modification time of the entry. If it is zero, Epoch is
+	// used.
+	ModTime time.Time
+}
+
+// File returns a regular file entry.
+func File(name string, mode os.FileMode, data []byte) *Entry {
+	return &Entry{
+		Path: name,
+		Mode: mode.Perm(),
+		Data: data,
+	}
+}
+
+// Dir returns a directory entry.
+func Dir(name string, mode os.FileMode) *Entry {
+	return &Entry{
+		Path: name,
+		Mode: os.ModeDir | mode.Perm(),
+	}
+}
+
+// Symlink returns a symlink entry pointing to target.
+func Symlink(name, target string) *Entry {
+	return &Entry{
+		Path:   name,
+		Mode:   os.ModeSymlink | 0777,
+		Target: target,
+	}
+}
+
+// cleanPath makes sure that a path stays inside the archive.
+func cleanPath(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid path '%s'", name)
+	}
+	return clean, nil
+}
+
+// header returns the tar header of an entry, with the given (clean) path.
+func (e *Entry) header(name string) (*tar.Header, error) {
+	modTime := e.ModTime
+	if modTime.IsZero() {
+		modTime = Epoch
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(e.Mode.Perm()),
+		Uid:     e.Uid,
+		Gid:     e.Gid,
+		ModTime: modTime.Truncate(time.Second),
+	}
+
+	switch {
+	case e.Mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case e.Mode&os.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = e.Target
+	case e.Mode.IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(len(e.Data))
+	default:
+		return nil, fmt.Errorf("%s: unsupported file type %s", name, e.Mode.Type())
+	}
+
+	return hdr, nil
+}
+
+// sortEntries cleans the paths of the entries and sorts them by path, so that
+// directories always come before their contents. It returns the sorted entries
+// along with their clean paths. Duplicate paths are an error, as are entries
+// inside a symlink entry, since they would end up wherever the symlink points.
+func sortEntries(entries []*Entry) ([]*Entry, []string, error) {
+	sorted := make([]*Entry, len(entries))
+	names := map[*Entry]string{}
+	for i, entry := range entries {
+		name, err := cleanPath(entry.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		names[entry] = name
+		sorted[i] = entry
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return names[sorted[i]] < names[sorted[j]]
+	})
+
+	sortedNames := make([]string, len(sorted))
+	symlinks := map[string]bool{}
+	for i, entry := range sorted {
+		name := names[entry]
+		if i > 0 && sortedNames[i-1] == name {
+			return nil, nil, fmt.Errorf("%s: duplicate path", name)
+		}
+		sortedNames[i] = name
+		if entry.Mode&os.ModeSymlink != 0 {
+			symlinks[name] = true
+		}
+	}
+
+	for _, name := range sortedNames {
+		for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+			if symlinks[parent] {
+				return nil, nil, fmt.Errorf("%s: parent %s is a symlink", name, parent)
+			}
+		}
+	}
+
+	return sorted, sortedNames, nil
+}
+
+// Write writes a tar archive containing the given entries to w. Entries are
+// written in order of their paths, so directories always come before their
+// contents. Duplicate paths and entries inside symlinks are errors.
+func Write(w io.Writer, entries []*Entry) error {
+	sorted, names, err := sortEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for i, entry := range sorted {
+		hdr, err := entry.header(names[i])
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(entry.Data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+// Archive returns a tar archive containing the given entries.
+func Archive(entries []*Entry) (io.Reader, error) {
+	archive := new(bytes.Buffer)
+	if err := Write(archive, entries); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(archive.Bytes()), nil
+}
+
+// WriteDir writes the given entries to a directory on disk (which is created
+// if it doesn't exist), so that they can be used with tools that need a real
+// filesystem. The same entries as for Write are rejected, so nothing is ever
+// written through a symlink entry. Modification times are set as in the archive, but ownership is
+// left alone since changing it usually requires root.
+func WriteDir(dir string, entries []*Entry) error {
+	sorted, names, err := sortEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for i, entry := range sorted {
+		name := names[i]
+		hdr, err := entry.header(name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, entry.Mode.Perm()); err != nil {
+				return err
+			}
+			err = os.Chmod(target, entry.Mode.Perm())
+		case tar.TypeSymlink:
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			// Symlinks don't have their own modification time on every
+			// platform, so leave it alone.
+			if err := os.Symlink(entry.Target, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeReg:
+			if err := ioutil.WriteFile(target, entry.Data, entry.Mode.Perm()); err != nil {
+				return err
+			}
+			err = os.Chmod(target, entry.Mode.Perm())
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package buildctx
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testEntries() []*Entry {
+	return []*Entry{
+		File("Dockerfile", 0644, []byte("FROM alpine\n")),
+		Dir("etc", 0755),
+		File("etc/torrc", 0600, []byte("SocksPort 0\n")),
+		Symlink("torrc", "etc/torrc"),
+	}
+}
+
+func archiveBytes(t *testing.T, entries []*Entry) []byte {
+	buf := new(bytes.Buffer)
+	if err := Write(buf, entries); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriteDeterministic(t *testing.T) {
+	expected := archiveBytes(t, testEntries())
+
+	// The order of the entries doesn't matter.
+	entries := testEntries()
+	reversed := make([]*Entry, len(entries))
+	for i, entry := range entries {
+		reversed[len(entries)-1-i] = entry
+	}
+	if got := archiveBytes(t, reversed); !bytes.Equal(got, expected) {
+		t.Errorf("archive depends on the order of the entries")
+	}
+
+	// Nor does the spelling of paths.
+	entries = testEntries()
+	entries[2].Path = "./etc//torrc"
+	if got := archiveBytes(t, entries); !bytes.Equal(got, expected) {
+		t.Errorf("archive depends on the spelling of paths")
+	}
+
+	// Nor does the type information in the mode of a regular file.
+	entries = testEntries()
+	entries[0].Mode |= os.ModeSetuid
+	if got := archiveBytes(t, entries); !bytes.Equal(got, expected) {
+		t.Errorf("archive depends on non-permission mode bits")
+	}
+}
+
+func TestWriteHeaders(t *testing.T) {
+	tr := tar.NewReader(bytes.NewReader(archiveBytes(t, testEntries())))
+
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading archive: %s", err)
+		}
+		names = append(names, hdr.Name)
+
+		// Nothing about the host makes it into the archive.
+		if hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s: has owner names %q:%q", hdr.Name, hdr.Uname, hdr.Gname)
+		}
+		if hdr.Uid != 0 || hdr.Gid != 0 {
+			t.Errorf("%s: has owner %d:%d", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+		if !hdr.ModTime.Equal(Epoch) {
+			t.Errorf("%s: has modification time %s", hdr.Name, hdr.ModTime)
+		}
+	}
+
+	expected := []string{"Dockerfile", "etc/", "etc/torrc", "torrc"}
+	if len(names) != len(expected) {
+		t.Fatalf("got entries %v, expected %v", names, expected)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("got entries %v, expected %v", names, expected)
+			break
+		}
+	}
+}
+
+func TestWriteInvalid(t *testing.T) {
+	for _, entries := range [][]*Entry{
+		// Duplicate paths.
+		{File("a", 0644, nil), File("./a", 0644, nil)},
+		{Dir("a", 0755), File("a/", 0644, nil)},
+		// Paths outside the archive.
+		{File("../a", 0644, nil)},
+		{File("a/../../b", 0644, nil)},
+		{File("/etc/passwd", 0644, nil)},
+		{File(".", 0644, nil)},
+		// Paths inside a symlink.
+		{Symlink("d", "/etc"), File("d/x", 0644, nil)},
+		{Symlink("d", "../.."), Dir("d/e", 0755), File("d/e/x", 0644, nil)},
+	} {
+		if err := Write(ioutil.Discard, entries); err == nil {
+			t.Errorf("write %s: expected an error", entries[len(entries)-1].Path)
+		}
+	}
+}
+
+func TestWriteDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildctx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := WriteDir(dir, testEntries()); err != nil {
+		t.Fatalf("write dir: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "torrc"))
+	if err != nil {
+		t.Fatalf("reading through symlink: %s", err)
+	}
+	if string(data) != "SocksPort 0\n" {
+		t.Errorf("torrc has content %q", data)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "etc", "torrc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("etc/torrc has mode %s", info.Mode())
+	}
+	if !info.ModTime().Equal(Epoch) {
+		t.Errorf("etc/torrc has modification time %s", info.ModTime())
+	}
+}
+
+func TestWriteDirSymlinkParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildctx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outside, err := ioutil.TempDir("", "buildctx-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	err = WriteDir(filepath.Join(dir, "ctx"), []*Entry{
+		Symlink("d", outside),
+		File("d/x", 0644, []byte("escaped")),
+	})
+	if err == nil {
+		t.Errorf("expected an error writing through a symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+		t.Errorf("file was written outside the directory")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "ctx")); !os.IsNotExist(err) {
+		t.Errorf("directory was created for invalid entries")
+	}
+}
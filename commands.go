@@ -0,0 +1,181 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+)
+
+// Each subcommand gets the arguments following the subcommand name, and is
+// responsible for parsing its own flags.
+var commands = map[string]func(args []string) error{
+	"ls":      cmdList,
+	"rm":      cmdRemove,
+	"inspect": cmdInspect,
+	"keygen":  cmdKeygen,
+	"key":     cmdKey,
+	"apply":   cmdApply,
+	"auth":    cmdAuth,
+	"update":  cmdUpdate,
+	"watch":   cmdWatch,
+}
+
+func newFlagSet(name, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n", os.Args[0], name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func cmdList(args []string) error {
+	var oQuiet bool
+
+	flags := newFlagSet("ls", "[-q]")
+	flags.BoolVar(&oQuiet, "q", false, "only print the identifiers of onion services")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return fmt.Errorf("ls takes no arguments")
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	svcs, err := FindOnionServices(cli)
+	if err != nil {
+		return fmt.Errorf("finding onion services: %s", err)
+	}
+
+	if oQuiet {
+		for _, svc := range svcs {
+			fmt.Println(svc.Ident)
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IDENT\tTARGETS\tONION\tSTATUS")
+	for _, svc := range svcs {
+		targets := strings.Join(svc.Targets, ",")
+		if targets == "" && svc.Labels != nil {
+			targets = svc.Labels.TargetName
+		}
+		if targets == "" {
+			targets = "-"
+		}
+		onion := svc.Onion
+		if len(svc.Services) > 0 {
+			var names []string
+			for name := range svc.Services {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			var onions []string
+			for _, name := range names {
+				onions = append(onions, name+"="+svc.Services[name])
+			}
+			onion = strings.Join(onions, ",")
+		}
+		if onion == "" {
+			onion = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", svc.Ident, targets, onion, svc.Status)
+	}
+	return w.Flush()
+}
+
+func cmdRemove(args []string) error {
+	var oVolumes bool
+
+	flags := newFlagSet("rm", "[-volumes] <ident|target>...")
+	flags.BoolVar(&oVolumes, "volumes", false, "also remove persistent key volumes (this loses the onion address)")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("must specify at least one onion service to remove")
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	var failed bool
+	for _, name := range flags.Args() {
+		svcs, err := FindOnionService(cli, name)
+		if err != nil {
+			log.Error(err)
+			failed = true
+			continue
+		}
+
+		for _, svc := range svcs {
+			if err := RemoveOnionService(cli, svc, oVolumes); err != nil {
+				log.Errorf("remove onion service %s: %s", svc.Ident, err)
+				failed = true
+				continue
+			}
+			log.WithFields(log.Fields{
+				"ident": svc.Ident,
+			}).Info("removed onion service")
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("failed to remove some onion services")
+	}
+	return nil
+}
+
+func cmdInspect(args []string) error {
+	flags := newFlagSet("inspect", "<ident|target>...")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("must specify at least one onion service to inspect")
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	var all []*OnionService
+	for _, name := range flags.Args() {
+		svcs, err := FindOnionService(cli, name)
+		if err != nil {
+			return err
+		}
+		all = append(all, svcs...)
+	}
+
+	data, err := json.MarshalIndent(all, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
@@ -8,7 +8,11 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
+	"net"
+	"strings"
 	"text/template"
 
 	"github.com/docker/engine-api/client"
@@ -16,16 +20,27 @@ import (
 
 const (
 	// Describes the entire torrc template.
-	// TODO: Make the hidden_service path customisable.
 	torTemplate = `
 # Disable SOCKS, we're only running as a hidden service.
 SocksPort 0
 
+# Allow mkonion to control Tor, from inside the container. Tor only lets the
+# user it runs as read the cookie, so other users in the container can't
+# authenticate (but root, and anyone with access to the Docker daemon, can).
+ControlPort 127.0.0.1:9051
+CookieAuthentication 1
+CookieAuthFile /var/lib/tor/control_auth_cookie
+{{range .Services}}
 # Set up hidden service.
-HiddenServiceDir /var/lib/tor/hidden_service
+HiddenServiceDir {{.Dir}}
+HiddenServiceVersion 3
 {{range .Targets}}
 HiddenServicePort {{.ExternalPort}} {{.}}
-{{end}}
+{{end}}{{end}}
+{{if .Options}}
+# Extra options.
+{{range $key, $value := .Options}}{{$key}} {{$value}}
+{{end}}{{end}}
 `
 )
 
@@ -39,6 +54,13 @@ func (t TargetIP) String() string {
 	return t.Addr + ":" + t.InternalPort
 }
 
+// TorService is a single hidden service in the torrc. A Tor container can run
+// several hidden services, each with its own directory (and thus its own key).
+type TorService struct {
+	Dir     string
+	Targets []TargetIP
+}
+
 // XXX: This is probably very horrible.
 var confTemplate = template.Must(template.New("tor").Parse(torTemplate))
 
@@ -54,19 +76,89 @@ func GenerateTargetMappings(ip string, mappings map[string]string) []TargetIP {
 	return targets
 }
 
-// GenerateConfig generates a configuraton file for a target container for a
-// given network. This is returned as a string, and warnings are logged if there
-// are any non-TCP ports exposed on the container.
-func GenerateConfig(cli *client.Client, targets []TargetIP) ([]byte, error) {
+// GenerateConfig generates a torrc for a set of hidden services, each of which
+// forwards to the given targets. Any extra options are added to the end of the
+// configuration.
+func GenerateConfig(cli *client.Client, services []TorService, options map[string]string) ([]byte, error) {
 	config := new(bytes.Buffer)
 
 	if err := confTemplate.Execute(config, struct {
-		Targets []TargetIP
+		Services []TorService
+		Options  map[string]string
 	}{
-		Targets: targets,
+		Services: services,
+		Options:  options,
 	}); err != nil {
 		return nil, err
 	}
 
 	return config.Bytes(), nil
 }
+
+// templateOptions are the torrc options generated by torTemplate itself, rather
+// than added as extra options.
+var templateOptions = map[string]bool{
+	"SocksPort":            true,
+	"ControlPort":          true,
+	"CookieAuthentication": true,
+	"CookieAuthFile":       true,
+	"HiddenServiceDir":     true,
+	"HiddenServiceVersion": true,
+	"HiddenServicePort":    true,
+}
+
+// ParseConfig recovers the hidden services and extra options from a torrc
+// generated by GenerateConfig. Since labels can't be changed once a resource
+// has been created, the torrc in the Tor container is the authoritative record
+// of how a running onion service is configured.
+func ParseConfig(torrc []byte) ([]TorService, map[string]string, error) {
+	var services []TorService
+	options := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(torrc))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		key, value := fields[0], ""
+		if len(fields) == 2 {
+			value = strings.TrimSpace(fields[1])
+		}
+
+		switch {
+		case key == "HiddenServiceDir":
+			services = append(services, TorService{Dir: value})
+		case key == "HiddenServicePort":
+			if len(services) == 0 {
+				return nil, nil, fmt.Errorf("HiddenServicePort before any HiddenServiceDir")
+			}
+
+			// The value is of the form "onion addr:container".
+			parts := strings.Fields(value)
+			if len(parts) != 2 {
+				return nil, nil, fmt.Errorf("invalid HiddenServicePort '%s'", value)
+			}
+			addr, port, err := net.SplitHostPort(parts[1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid HiddenServicePort '%s': %s", value, err)
+			}
+
+			svc := &services[len(services)-1]
+			svc.Targets = append(svc.Targets, TargetIP{
+				Addr:         addr,
+				InternalPort: port,
+				ExternalPort: parts[0],
+			})
+		case !templateOptions[key]:
+			options[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return services, options, nil
+}
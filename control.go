@@ -0,0 +1,511 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+)
+
+// Every Tor container listens on a ControlPort, which lets us create onion
+// services with ADD_ONION and find out when their descriptors have actually
+// been published. The ControlPort only listens on localhost, and mkonion
+// reaches it by running nc inside the Tor container (using the Docker API), so
+// this works even if mkonion can't reach the onion network (such as when the
+// Docker daemon is on another host, or the network is internal). Connections
+// are also authenticated using SAFECOOKIE. Tor writes the cookie with mode
+// 0600, so only the user Tor runs as (and root) can read it inside the
+// container, though anyone with access to the Docker daemon can copy it out.
+// See control-spec.txt in the Tor source for the details of the protocol.
+
+const (
+	ControlPort       = "9051"
+	ControlCookieFile = "/var/lib/tor/control_auth_cookie"
+
+	// controlDialTimeout is how long we wait for Tor to write the control
+	// cookie, which it does once it starts listening on the ControlPort.
+	controlDialTimeout = 30 * time.Second
+
+	// DefaultPublishTimeout is how long we wait for the descriptors of new
+	// onion services to be published by default.
+	DefaultPublishTimeout = 3 * time.Minute
+
+	// descriptorFetchInterval is how often we try to fetch the descriptors
+	// we're waiting for, in case we missed them being uploaded.
+	descriptorFetchInterval = 30 * time.Second
+
+	safeCookieServerKey = "Tor safe cookie authentication server-to-controller hash"
+	safeCookieClientKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+// ControlReply is a (possibly multi-line) reply from Tor.
+type ControlReply struct {
+	Code  int
+	Lines []string
+}
+
+// Err returns an error if the reply is not a success.
+func (r *ControlReply) Err() error {
+	if r.Code/100 == 2 {
+		return nil
+	}
+	return fmt.Errorf("tor: %d %s", r.Code, strings.Join(r.Lines, "; "))
+}
+
+// ControlConn is an authenticated connection to the ControlPort of Tor.
+type ControlConn struct {
+	conn net.Conn
+	r    *textproto.Reader
+
+	// Asynchronous events can arrive in the middle of a command, so they are
+	// queued until someone asks for them.
+	events []string
+}
+
+// readContainerFile reads a single file from a container.
+func readContainerFile(cli *client.Client, containerID, file string) ([]byte, error) {
+	content, _, err := cli.CopyFromContainer(containerID, file)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	tr := tar.NewReader(content)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Name == path.Base(file) {
+			return ioutil.ReadAll(tr)
+		}
+	}
+
+	return nil, fmt.Errorf("%s not in copied archive", file)
+}
+
+// execStream reads the standard output of an exec from the stream returned by
+// ContainerExecAttach, in which each chunk of output is prefixed by a header
+// giving the stream it was written to and its length. Anything written to
+// standard error is discarded.
+type execStream struct {
+	r io.Reader
+
+	header  [8]byte
+	nheader int
+	stream  byte
+	left    int
+}
+
+func (s *execStream) Read(p []byte) (int, error) {
+	for {
+		for s.left == 0 {
+			n, err := s.r.Read(s.header[s.nheader:])
+			s.nheader += n
+			if s.nheader == len(s.header) {
+				s.stream = s.header[0]
+				s.left = int(binary.BigEndian.Uint32(s.header[4:]))
+				s.nheader = 0
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		buf := p
+		if len(buf) > s.left {
+			buf = buf[:s.left]
+		}
+		n, err := s.r.Read(buf)
+		s.left -= n
+		if s.stream == 1 && n > 0 {
+			return n, err
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// DialControl connects to the ControlPort of the Tor daemon in the given
+// container, by running nc in the container, and authenticates using the
+// control cookie. We wait for Tor to start listening if necessary.
+func DialControl(cli *client.Client, containerID string) (*ControlConn, error) {
+	var (
+		cookie []byte
+		err    error
+	)
+	deadline := time.Now().Add(controlDialTimeout)
+	for {
+		// Tor writes the cookie once it starts listening.
+		cookie, err = readContainerFile(cli, containerID, ControlCookieFile)
+		if err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("waiting for tor control cookie: %s", err)
+		}
+		if inspect, err := cli.ContainerInspect(containerID); err != nil {
+			return nil, fmt.Errorf("error inspecting container: %s", err)
+		} else if !isRunning(inspect.State) {
+			return nil, fmt.Errorf("container died before tor control port was available")
+		}
+
+		log.Debugf("tor control cookie not available (%s), retrying after a short nap...", err)
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	config := types.ExecConfig{
+		Container:    containerID,
+		Cmd:          []string{"nc", "127.0.0.1", ControlPort},
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	exec, err := cli.ContainerExecCreate(config)
+	if err != nil {
+		return nil, fmt.Errorf("running nc in tor container: %s", err)
+	}
+	resp, err := cli.ContainerExecAttach(exec.ID, config)
+	if err != nil {
+		return nil, fmt.Errorf("attaching to nc in tor container: %s", err)
+	}
+
+	c := &ControlConn{
+		conn: resp.Conn,
+		r:    textproto.NewReader(bufio.NewReader(&execStream{r: resp.Reader})),
+	}
+	if err := c.authenticate(cookie); err != nil {
+		c.Close()
+		// If nc couldn't connect, all we see is the end of the stream.
+		if err == io.EOF {
+			err = fmt.Errorf("nc exited, is tor listening on %s?", ControlPort)
+		}
+		return nil, fmt.Errorf("authenticating to tor control port: %s", err)
+	}
+	return c, nil
+}
+
+// Close closes the control connection. Onion services created with
+// ADD_ONION are detached, so they outlive the connection.
+func (c *ControlConn) Close() error {
+	return c.conn.Close()
+}
+
+// readReply reads a single reply from Tor, including data lines.
+func (c *ControlConn) readReply() (*ControlReply, error) {
+	reply := new(ControlReply)
+	for {
+		line, err := c.r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed reply line '%s'", line)
+		}
+
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed reply line '%s'", line)
+		}
+		reply.Code = code
+		reply.Lines = append(reply.Lines, line[4:])
+
+		switch line[3] {
+		case ' ':
+			return reply, nil
+		case '-':
+		case '+':
+			data, err := c.r.ReadDotLines()
+			if err != nil {
+				return nil, err
+			}
+			reply.Lines = append(reply.Lines, data...)
+		default:
+			return nil, fmt.Errorf("malformed reply line '%s'", line)
+		}
+	}
+}
+
+// Command sends a command to Tor and returns its reply. An error is returned
+// if Tor didn't reply with success.
+func (c *ControlConn) Command(format string, args ...interface{}) (*ControlReply, error) {
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", args...); err != nil {
+		return nil, err
+	}
+
+	for {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+
+		// Queue asynchronous events.
+		if reply.Code == 650 {
+			c.events = append(c.events, reply.Lines[0])
+			continue
+		}
+
+		return reply, reply.Err()
+	}
+}
+
+// NextEvent returns the next asynchronous event, waiting until the deadline
+// if there aren't any queued.
+func (c *ControlConn) NextEvent(deadline time.Time) (string, error) {
+	for len(c.events) == 0 {
+		if err := c.conn.SetReadDeadline(deadline); err != nil {
+			return "", err
+		}
+		reply, err := c.readReply()
+		c.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return "", err
+		}
+
+		if reply.Code != 650 {
+			return "", fmt.Errorf("unexpected reply: %d %s", reply.Code, strings.Join(reply.Lines, "; "))
+		}
+		c.events = append(c.events, reply.Lines[0])
+	}
+
+	event := c.events[0]
+	c.events = c.events[1:]
+	return event, nil
+}
+
+func safeCookieHash(key string, cookie, clientNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(cookie)
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	return mac.Sum(nil)
+}
+
+// authenticate does SAFECOOKIE authentication. Unlike plain COOKIE
+// authentication, this also makes sure that Tor knows the cookie.
+func (c *ControlConn) authenticate(cookie []byte) error {
+	clientNonce := make([]byte, 32)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+
+	reply, err := c.Command("AUTHCHALLENGE SAFECOOKIE %s", hex.EncodeToString(clientNonce))
+	if err != nil {
+		return err
+	}
+
+	// The reply is of the form
+	//   AUTHCHALLENGE SERVERHASH=<hex> SERVERNONCE=<hex>
+	values := map[string]string{}
+	for _, field := range strings.Fields(reply.Lines[0]) {
+		if parts := strings.SplitN(field, "=", 2); len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+
+	serverHash, err := hex.DecodeString(values["SERVERHASH"])
+	if err != nil {
+		return fmt.Errorf("invalid SERVERHASH: %s", err)
+	}
+	serverNonce, err := hex.DecodeString(values["SERVERNONCE"])
+	if err != nil {
+		return fmt.Errorf("invalid SERVERNONCE: %s", err)
+	}
+
+	if !hmac.Equal(serverHash, safeCookieHash(safeCookieServerKey, cookie, clientNonce, serverNonce)) {
+		return fmt.Errorf("tor doesn't know the control cookie")
+	}
+
+	_, err = c.Command("AUTHENTICATE %s", hex.EncodeToString(safeCookieHash(safeCookieClientKey, cookie, clientNonce, serverNonce)))
+	return err
+}
+
+// AddOnion creates a new (detached) ephemeral onion service with ADD_ONION,
+// returning its onion address. If key is nil, Tor generates a new key (which
+// is discarded). Clients maps client names to x25519 public keys, as for
+// authorized_clients.
+func (c *ControlConn) AddOnion(key *OnionKey, targets []TargetIP, clients map[string]string) (string, error) {
+	keyBlob := "NEW:ED25519-V3"
+	flags := []string{"Detach", "DiscardPK"}
+	if key != nil {
+		keyBlob = "ED25519-V3:" + base64.StdEncoding.EncodeToString(key.Secret)
+		flags = []string{"Detach"}
+	}
+
+	// Sort the ports to make the command deterministic.
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].ExternalPort < targets[j].ExternalPort
+	})
+
+	cmd := new(bytes.Buffer)
+	fmt.Fprintf(cmd, "ADD_ONION %s Flags=%s", keyBlob, strings.Join(flags, ","))
+	for _, target := range targets {
+		fmt.Fprintf(cmd, " Port=%s,%s", target.ExternalPort, target)
+	}
+	for name, public := range clients {
+		public, err := decodeX25519Key(public)
+		if err != nil {
+			return "", fmt.Errorf("client %s: %s", name, err)
+		}
+		fmt.Fprintf(cmd, " ClientAuthV3=%s", encodeX25519Key(public))
+	}
+
+	reply, err := c.Command("%s", cmd.String())
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range reply.Lines {
+		if strings.HasPrefix(line, "ServiceID=") {
+			return strings.TrimPrefix(line, "ServiceID=") + ".onion", nil
+		}
+	}
+	return "", fmt.Errorf("tor didn't return the ServiceID of the new onion service")
+}
+
+// DetachedOnions returns the onion addresses of the detached onion services
+// created with ADD_ONION.
+func (c *ControlConn) DetachedOnions() ([]string, error) {
+	reply, err := c.Command("GETINFO onions/detached")
+	if err != nil {
+		return nil, err
+	}
+
+	var onions []string
+	for _, line := range reply.Lines {
+		// The reply is a data reply of the form
+		//   onions/detached=
+		//   <ServiceID>...
+		//   OK
+		line = strings.TrimPrefix(line, "onions/detached=")
+		if line == "" || line == "OK" {
+			continue
+		}
+		onions = append(onions, line+".onion")
+	}
+	return onions, nil
+}
+
+// WatchDescriptors subscribes to HS_DESC events. This should be done before
+// the descriptors are uploaded, otherwise WaitForPublication only notices them
+// once it fetches them.
+func (c *ControlConn) WatchDescriptors() error {
+	_, err := c.Command("SETEVENTS HS_DESC")
+	return err
+}
+
+// WaitForPublication waits until the descriptor of each of the given onion
+// services has been uploaded to at least one HSDir. In case we missed the
+// upload, we also periodically ask Tor to fetch the descriptors (with
+// HSFETCH), which can only succeed once they have been published.
+func (c *ControlConn) WaitForPublication(onions []string, timeout time.Duration) error {
+	pending := map[string]bool{}
+	for _, onion := range onions {
+		pending[strings.TrimSuffix(onion, ".onion")] = true
+	}
+
+	var lastFailure string
+	deadline := time.Now().Add(timeout)
+	nextFetch := time.Now().Add(descriptorFetchInterval)
+	for len(pending) > 0 {
+		wait := deadline
+		if nextFetch.Before(wait) {
+			wait = nextFetch
+		}
+
+		event, err := c.NextEvent(wait)
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() && time.Now().Before(deadline) {
+			for addr := range pending {
+				if _, err := c.Command("HSFETCH %s", addr); err != nil {
+					log.Debugf("fetching descriptor of %s.onion: %s", addr, err)
+				}
+			}
+			nextFetch = time.Now().Add(descriptorFetchInterval)
+			continue
+		} else if ok && nerr.Timeout() {
+			var addrs []string
+			for addr := range pending {
+				addrs = append(addrs, addr+".onion")
+			}
+			sort.Strings(addrs)
+
+			msg := fmt.Sprintf("timed out after %s waiting for descriptors of %s to be published", timeout, strings.Join(addrs, ", "))
+			if lastFailure != "" {
+				msg += " (last failure: " + lastFailure + ")"
+			}
+			return fmt.Errorf("%s", msg)
+		} else if err != nil {
+			return err
+		}
+
+		// The event is of the form
+		//   HS_DESC <action> <address> <auth> <hsdir> [<descid>] [REASON=<reason>]
+		fields := strings.Fields(event)
+		if len(fields) < 5 || fields[0] != "HS_DESC" || !pending[fields[2]] {
+			continue
+		}
+		action, addr, hsdir := fields[1], fields[2], fields[4]
+
+		var reason string
+		for _, field := range fields[5:] {
+			if strings.HasPrefix(field, "REASON=") {
+				reason = strings.TrimPrefix(field, "REASON=")
+			}
+		}
+
+		switch action {
+		case "UPLOADED", "RECEIVED":
+			log.WithFields(log.Fields{
+				"onion": addr + ".onion",
+				"hsdir": hsdir,
+			}).Info("onion service descriptor published")
+			delete(pending, addr)
+		case "FAILED":
+			// Our fetches fail until the descriptor has been uploaded, so
+			// only uploads are interesting.
+			if reason != "UPLOAD_REJECTED" {
+				log.Debugf("fetching descriptor of %s.onion from %s failed: %s", addr, hsdir, reason)
+				continue
+			}
+			lastFailure = "upload to " + hsdir + " failed: " + reason
+			log.WithFields(log.Fields{
+				"onion": addr + ".onion",
+			}).Warnf("onion service descriptor %s", lastFailure)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,1143 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/go-connections/nat"
+)
+
+// CreateOptions describes a new onion service.
+type CreateOptions struct {
+	// Target is the name (or ID) of the target container.
+	Target string
+	// Name is a readable name for the onion service, which is used (with the
+	// usual prefix) as its identifier. If empty, a random one is used.
+	Name string
+	// Mappings is the list of extra port mappings, of the form
+	// [onion:]container[/udp]. UDP mappings need OnionCat.
+	Mappings []string
+	// Key is the keypair to use. If nil, a new one is generated (by Tor, for
+	// ephemeral onion services).
+	Key *OnionKey
+	// Services describes several named onion services for the target, each
+	// with its own ports and key. If it is non-empty, Mappings and Key must
+	// not be set, and the exposed ports of the target are not forwarded.
+	Services []*ServiceOptions
+	// Persist stores the hidden_service directory in a named volume.
+	Persist bool
+	// Shared serves the onion service from the shared Tor daemon rather than
+	// starting a new Tor container.
+	Shared bool
+	// Ephemeral creates the onion service with ADD_ONION rather than in the
+	// torrc, so it only exists for as long as the Tor process does.
+	Ephemeral bool
+	// PublishTimeout is how long to wait for the descriptors of the onion
+	// services to be published. If zero, we don't wait.
+	PublishTimeout time.Duration
+	// Image describes where to get the Tor image from.
+	Image *ImageOptions
+	// Network describes the onion network. If nil, the defaults are used.
+	Network *NetworkOptions
+	// NetworkName is an existing network (which the target is connected to)
+	// for the Tor container to join, rather than creating an onion network.
+	NetworkName string
+	// Clients maps client names to base32-encoded x25519 public keys. If it is
+	// non-empty, only those clients can access the onion service.
+	Clients map[string]string
+	// TorOptions are extra options added to the torrc.
+	TorOptions map[string]string
+	// Isolate routes all of the traffic of the target through Tor, and
+	// disconnects it from every other network.
+	Isolate bool
+	// OnionCat runs an OnionCat container next to Tor, so that the UDP ports
+	// of the target can be reached over the onion service.
+	OnionCat bool
+	// Replaces lists the onion services of the target which this one
+	// replaces, and which are removed once it has been created.
+	Replaces []*OnionService
+	// Spec is the hash of the declarative spec the service was created from,
+	// if it was created by `mkonion apply`.
+	Spec string
+}
+
+// ServiceOptions describes one of several onion services run for the same
+// target by a single Tor container.
+type ServiceOptions struct {
+	// Name is the name of the service, which is also the name of its
+	// directory inside HiddenServiceDir.
+	Name string
+	// Mappings is the list of port mappings, of the form [onion:]container.
+	Mappings []string
+	// Key is the keypair to use. If nil, a new one is generated.
+	Key *OnionKey
+}
+
+var serviceNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// CreateResult describes an onion service which was just created.
+type CreateResult struct {
+	Ident       string            `json:"ident" yaml:"ident"`
+	Network     string            `json:"network" yaml:"network"`
+	NetworkID   string            `json:"network_id" yaml:"network_id"`
+	ContainerID string            `json:"container_id" yaml:"container_id"`
+	Target      string            `json:"target" yaml:"target"`
+	TargetIP    string            `json:"target_ip" yaml:"target_ip"`
+	Ports       map[string]string `json:"ports,omitempty" yaml:"ports,omitempty"`
+	Onion       string            `json:"onion,omitempty" yaml:"onion,omitempty"`
+	UDPPorts    map[string]string `json:"udp_ports,omitempty" yaml:"udp_ports,omitempty"`
+	OnionCat    string            `json:"onioncat,omitempty" yaml:"onioncat,omitempty"`
+	Services    []*ServiceResult  `json:"services,omitempty" yaml:"services,omitempty"`
+}
+
+// ServiceResult describes one of several onion services which were just
+// created for the same target.
+type ServiceResult struct {
+	Name  string            `json:"name" yaml:"name"`
+	Ports map[string]string `json:"ports" yaml:"ports"`
+	Onion string            `json:"onion" yaml:"onion"`
+}
+
+func IsInteger(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// ValidateMappings checks that the port mappings are all of the form
+// [onion:]container[/proto], where proto is tcp or udp.
+func ValidateMappings(mappings []string) error {
+	for _, arg := range mappings {
+		arg = strings.TrimSuffix(strings.TrimSuffix(arg, "/tcp"), "/udp")
+		ports := strings.SplitN(arg, ":", 2)
+		if len(ports) == 0 || len(ports) > 2 {
+			return fmt.Errorf("port mappings must be of the form '[onion:]container[/udp]'")
+		}
+
+		for _, port := range ports {
+			if !IsInteger(port) {
+				return fmt.Errorf("port mappings must be integers")
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateTorOptions makes sure that extra torrc options can't break out of
+// their line.
+func ValidateTorOptions(options map[string]string) error {
+	for key, value := range options {
+		if key == "" || strings.ContainsAny(key, " \t\r\n#") {
+			return fmt.Errorf("invalid tor option name '%s'", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("tor option %s cannot contain newlines", key)
+		}
+	}
+	return nil
+}
+
+// ValidateServices checks that a set of named onion services don't conflict.
+func ValidateServices(services []*ServiceOptions) error {
+	names := map[string]bool{}
+	onions := map[string]bool{}
+	for _, svc := range services {
+		if !serviceNameRegexp.MatchString(svc.Name) {
+			return fmt.Errorf("invalid service name '%s': must only contain [a-zA-Z0-9_-]", svc.Name)
+		}
+		if names[svc.Name] {
+			return fmt.Errorf("service %s: declared more than once", svc.Name)
+		}
+		names[svc.Name] = true
+
+		if len(svc.Mappings) == 0 {
+			return fmt.Errorf("service %s: must specify at least one port", svc.Name)
+		}
+		if err := ValidateMappings(svc.Mappings); err != nil {
+			return fmt.Errorf("service %s: %s", svc.Name, err)
+		}
+
+		if svc.Key != nil {
+			onion := svc.Key.Hostname()
+			if onions[onion] {
+				return fmt.Errorf("service %s: key is used by more than one service", svc.Name)
+			}
+			onions[onion] = true
+		}
+	}
+	return nil
+}
+
+// BuildPortMappings combines the exposed ports of the target with the extra
+// mappings given by the user, returning a map from onion ports to container
+// ports.
+func BuildPortMappings(ports []nat.Port, mappings []string) (map[string]string, error) {
+	// Add all exposed ports naively to mappings before parsing arguments.
+	portMappings := map[string]string{}
+	for _, port := range ports {
+		log.Infof("forwarding port: %s", port)
+		if port.Proto() != "tcp" {
+			log.Warnf("encountered non-TCP exposed port in container (use -onioncat to forward UDP ports): %s", port)
+		}
+		portMappings[port.Port()] = port.Port()
+	}
+
+	// Now deal with arguments.
+	for _, arg := range mappings {
+		var onion, container string
+
+		if strings.HasSuffix(arg, "/udp") {
+			return nil, fmt.Errorf("UDP port mappings can only be forwarded with onioncat")
+		}
+		ports := strings.SplitN(strings.TrimSuffix(arg, "/tcp"), ":", 2)
+		onion = ports[0]
+
+		// The format is [onion:]container.
+		switch len(ports) {
+		case 2:
+			container = ports[1]
+		case 1:
+			container = ports[0]
+		default:
+			return nil, fmt.Errorf("port mappings must be of the form '[onion:]container'")
+		}
+
+		// Can't redefine external mappings.
+		if _, ok := portMappings[onion]; ok {
+			return nil, fmt.Errorf("cannot have multiple definitons of onion port mappings")
+		}
+
+		portMappings[onion] = container
+	}
+
+	return portMappings, nil
+}
+
+// LoadOnionKey loads the keypair from a hs_ed25519_secret_key file, or a
+// directory containing one.
+func LoadOnionKey(path string) (*OnionKey, error) {
+	// Allow users to pass the directory written by `mkonion keygen`.
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, SecretKeyFile)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading private key: %s", err)
+	}
+
+	key, err := ParseSecretKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %s", err)
+	}
+
+	// If the public key is next to the secret key (as in a hidden_service
+	// directory), make sure they actually match.
+	publicPath := filepath.Join(filepath.Dir(path), PublicKeyFile)
+	if data, err := ioutil.ReadFile(publicPath); err == nil {
+		public, err := ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing public key: %s", err)
+		}
+		if !bytes.Equal(public, key.Public) {
+			return nil, fmt.Errorf("public key %s does not match private key", publicPath)
+		}
+	}
+
+	return key, nil
+}
+
+// createPlan is everything about a new onion service which can be worked out
+// without changing the state of the daemon.
+type createPlan struct {
+	target       types.ContainerJSON
+	ident        string
+	labels       *ServiceLabels
+	services     []*ServiceOptions
+	servicePorts map[string]map[string]string
+}
+
+// rename changes the identifier of a planned onion service.
+func (plan *createPlan) rename(ident string) {
+	plan.ident = ident
+	plan.labels.Ident = ident
+	if plan.labels.OnionCat != "" {
+		plan.labels.OnionCat = onionCatName(ident)
+	}
+}
+
+// setServices replaces the services of a planned onion service (once their
+// keys are known), and updates the onion addresses in its labels.
+func (plan *createPlan) setServices(services []*ServiceOptions) {
+	plan.services = services
+	for _, svc := range services {
+		if svc.Key == nil {
+			continue
+		}
+		if svc.Name == "" {
+			plan.labels.Onion = svc.Key.Hostname()
+		} else if svcLabels := plan.labels.Services[svc.Name]; svcLabels != nil {
+			svcLabels.Onion = svc.Key.Hostname()
+		}
+	}
+}
+
+// generateMissingKeys returns a copy of services in which every service
+// without a key has a newly generated one.
+func generateMissingKeys(services []*ServiceOptions) ([]*ServiceOptions, error) {
+	var result []*ServiceOptions
+	for _, svc := range services {
+		if svc.Key == nil {
+			key, err := GenerateOnionKey(rand.Reader)
+			if err != nil {
+				return nil, fmt.Errorf("generating key: %s", err)
+			}
+			copied := *svc
+			copied.Key = key
+			svc = &copied
+		}
+		result = append(result, svc)
+	}
+	return result, nil
+}
+
+// planOnionService validates the options and works out the identifier, labels
+// and port mappings of a new onion service. It only reads from the daemon.
+func planOnionService(cli *client.Client, options *CreateOptions) (*createPlan, error) {
+	if err := ValidateMappings(options.Mappings); err != nil {
+		return nil, err
+	}
+	if err := ValidateTorOptions(options.TorOptions); err != nil {
+		return nil, err
+	}
+	if options.Network != nil {
+		if err := options.Network.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.Services) > 0 && (len(options.Mappings) > 0 || options.Key != nil) {
+		return nil, fmt.Errorf("cannot specify port mappings or a key as well as named services")
+	}
+	if err := ValidateServices(options.Services); err != nil {
+		return nil, err
+	}
+	if options.Shared && (options.Persist || len(options.Services) > 0 || len(options.TorOptions) > 0) {
+		return nil, fmt.Errorf("cannot use a persistent volume, named services or extra tor options with the shared tor daemon")
+	}
+	if options.Ephemeral && (options.Persist || options.Shared || len(options.Services) > 0) {
+		return nil, fmt.Errorf("cannot use a persistent volume, the shared tor daemon or named services with ephemeral onion services")
+	}
+	// Onion services served by the shared Tor daemon are only labelled on
+	// their onion network, which only bridge networks can be.
+	if options.Shared && options.Network != nil && options.Network.Driver != "" && options.Network.Driver != DefaultNetworkDriver {
+		return nil, fmt.Errorf("cannot use the shared tor daemon with the %s network driver", options.Network.Driver)
+	}
+	if options.Isolate && options.Shared {
+		return nil, fmt.Errorf("cannot isolate the target of an onion service served by the shared tor daemon")
+	}
+	if options.OnionCat && (options.Shared || options.Ephemeral || len(options.Services) > 0) {
+		return nil, fmt.Errorf("cannot use onioncat with the shared tor daemon, ephemeral onion services or named services")
+	}
+	if options.NetworkName != "" && (options.Shared || options.Isolate || options.OnionCat) {
+		return nil, fmt.Errorf("cannot use an existing network with the shared tor daemon, an isolated target or onioncat")
+	}
+	if options.NetworkName != "" && options.Network != nil && !options.Network.IsDefault() {
+		return nil, fmt.Errorf("cannot configure an existing network")
+	}
+	if options.Isolate {
+		for key := range isolateTorOptions {
+			if _, ok := options.TorOptions[key]; ok {
+				return nil, fmt.Errorf("cannot set tor option %s when isolating the target", key)
+			}
+		}
+	}
+	for name, public := range options.Clients {
+		if _, err := AuthorizedClientFile(name, public); err != nil {
+			return nil, err
+		}
+	}
+
+	target, err := cli.ContainerInspect(options.Target)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting target: %s", err)
+	}
+
+	ports, err := FindTargetPorts(cli, target.ID)
+	if err != nil {
+		return nil, fmt.Errorf("finding target ports: %s", err)
+	}
+
+	var network string
+	if options.NetworkName != "" {
+		reused, err := CheckReusableNetwork(cli, options.NetworkName, target)
+		if err != nil {
+			return nil, err
+		}
+		network = reused.Name
+	}
+
+	ident, err := NewIdentifier(cli, options.Name)
+	if err != nil {
+		return nil, err
+	}
+	labels := &ServiceLabels{
+		Ident:      ident,
+		Target:     target.ID,
+		TargetName: strings.TrimPrefix(target.Name, "/"),
+		Spec:       options.Spec,
+		Ephemeral:  options.Ephemeral,
+		Network:    network,
+		Version:    Version,
+		Created:    time.Now(),
+	}
+
+	// Without any named services, we run a single (unnamed) onion service
+	// which forwards all of the exposed ports.
+	services := options.Services
+	servicePorts := map[string]map[string]string{}
+	if len(services) == 0 {
+		services = []*ServiceOptions{{
+			Mappings: options.Mappings,
+			Key:      options.Key,
+		}}
+
+		// UDP ports are forwarded by OnionCat rather than Tor.
+		mappings := options.Mappings
+		if options.OnionCat {
+			var udpPorts []nat.Port
+			var udpMappings []string
+			ports, udpPorts = splitUDPPorts(ports)
+			mappings, udpMappings = splitUDPMappings(mappings)
+
+			labels.OnionCat = onionCatName(ident)
+			labels.UDPPorts, err = BuildUDPPortMappings(udpPorts, udpMappings)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		labels.Ports, err = BuildPortMappings(ports, mappings)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := labels.Ports[OnionCatPort]; ok && options.OnionCat {
+			return nil, fmt.Errorf("onion port %s is used by onioncat", OnionCatPort)
+		}
+		servicePorts[""] = labels.Ports
+
+		// If we were given a key we already know what the address will be.
+		if options.Key != nil {
+			labels.Onion = options.Key.Hostname()
+		}
+	} else {
+		labels.Services = map[string]*NamedServiceLabels{}
+		for _, svc := range services {
+			portMappings, err := BuildPortMappings(nil, svc.Mappings)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %s", svc.Name, err)
+			}
+			servicePorts[svc.Name] = portMappings
+
+			svcLabels := &NamedServiceLabels{Ports: portMappings}
+			if svc.Key != nil {
+				svcLabels.Onion = svc.Key.Hostname()
+			}
+			labels.Services[svc.Name] = svcLabels
+		}
+	}
+
+	if options.Shared {
+		labels.Daemon = SharedDaemonName
+	}
+	if options.Persist {
+		labels.Volume = persistentVolumeName(labels.TargetName)
+	}
+	if options.Isolate {
+		labels.Isolate = true
+		labels.IsolatedFrom, err = isolatedNetworks(target)
+		if err != nil {
+			return nil, err
+		}
+		labels.IsolatedFrom = replaceIsolation(labels.IsolatedFrom, options.Replaces)
+		labels.IsolatedAliases = isolatedAliases(target, labels.IsolatedFrom, options.Replaces)
+	}
+
+	return &createPlan{
+		target:       target,
+		ident:        ident,
+		labels:       labels,
+		services:     services,
+		servicePorts: servicePorts,
+	}, nil
+}
+
+// createStep is one of the steps of creating an onion service. Dry runs use
+// the same steps as CreateOnionService, but only print their actions.
+type createStep struct {
+	// actions describes the changes the step makes to the daemon. Steps which
+	// only read from the daemon have no actions.
+	actions []string
+	run     func() error
+}
+
+// createRun is the state of an onion service being created, which is filled in
+// by each step as it runs.
+type createRun struct {
+	cli     *client.Client
+	txn     *Transaction
+	options *CreateOptions
+	plan    *createPlan
+
+	// dockerfile is the Dockerfile of the Tor image, if it has to be built.
+	dockerfile string
+	// addr and onionCatAddr are the addresses Tor forwards to. Until they
+	// are known they stand in for the real addresses, for dry runs.
+	addr         string
+	onionCatAddr string
+	// resolves is whether the Tor image resolves aliases.
+	resolves bool
+
+	networkID   string
+	ip          string
+	imageID     string
+	containerID string
+	onionCatID  string
+	ctrl        *ControlConn
+	onions      []string
+	result      *CreateResult
+}
+
+// steps works out the steps needed to create the planned onion service, in
+// the order they are run. It only reads from the daemon.
+func (cr *createRun) steps() ([]createStep, error) {
+	cli, options := cr.cli, cr.options
+	ident, labels := cr.plan.ident, cr.plan.labels
+
+	var steps []createStep
+	add := func(run func() error, actions ...string) {
+		steps = append(steps, createStep{actions: actions, run: run})
+	}
+
+	if options.Persist {
+		action := "create volume " + labels.Volume
+		if _, err := cli.VolumeInspect(labels.Volume); err == nil {
+			action = "use existing volume " + labels.Volume
+		} else if !client.IsErrVolumeNotFound(err) {
+			return nil, err
+		}
+		add(cr.createKeyVolume, action)
+	}
+	if !options.Ephemeral {
+		add(cr.generateKeys)
+	}
+
+	if labels.Network == "" {
+		network, err := networkCreateConfig(cli, ident, options.Network, options.Isolate, nil)
+		if err != nil {
+			return nil, err
+		}
+		add(cr.createNetwork, "create "+describeNetwork(network))
+		add(cr.connectTarget, fmt.Sprintf("connect container %s to network %s with alias %s", labels.TargetName, ident, targetAlias(ident)))
+	} else {
+		add(cr.useNetwork)
+	}
+	add(cr.findTarget)
+
+	if options.Shared {
+		var actions []string
+		resolves := false
+		daemon, err := cli.ContainerInspect(SharedDaemonName)
+		switch {
+		case err == nil:
+			if !isRunning(daemon.State) {
+				actions = append(actions, "start container "+SharedDaemonName)
+			}
+			resolves, err = imageResolvesAliases(cli, daemon.Image)
+			if err != nil {
+				return nil, err
+			}
+		case client.IsErrContainerNotFound(err):
+			ref, action, imageResolves, err := cr.planTorImage()
+			if err != nil {
+				return nil, err
+			}
+			resolves = imageResolves
+			actions = append(actions, action, fmt.Sprintf("create and start container %s from image %s", SharedDaemonName, ref))
+		default:
+			return nil, err
+		}
+		add(cr.startSharedDaemon, actions...)
+
+		cr.addr = dryRunTargetIP
+		if resolves {
+			cr.addr = targetAlias(ident)
+		}
+
+		files, err := describeFiles([]*ServiceOptions{{
+			Name: ident,
+			Key:  cr.plan.services[0].Key,
+		}}, options.Clients)
+		if err != nil {
+			return nil, err
+		}
+		add(cr.addSharedService,
+			fmt.Sprintf("connect container %s to network %s", SharedDaemonName, ident),
+			fmt.Sprintf("copy %s into %s:%s", files, SharedDaemonName, HiddenServiceDir),
+			fmt.Sprintf("regenerate the torrc of %s and reload tor", SharedDaemonName))
+	} else {
+		ref, action, resolves, err := cr.planTorImage()
+		if err != nil {
+			return nil, err
+		}
+		add(cr.ensureTorImage, action)
+
+		cr.addr, cr.onionCatAddr = dryRunTargetIP, dryRunOnionCatIP
+		if resolves {
+			cr.addr, cr.onionCatAddr = labels.TargetAlias(), onionCatAlias(ident)
+		}
+
+		if options.OnionCat {
+			ref := onionCatImageTag()
+			action := "build image " + ref
+			if _, _, err := cli.ImageInspectWithRaw(ref, false); err == nil {
+				action = "use existing image " + ref
+			} else if !client.IsErrImageNotFound(err) {
+				return nil, err
+			}
+			add(cr.runOnionCat, action,
+				fmt.Sprintf("create and start container %s from image %s with NET_ADMIN and /dev/net/tun", labels.OnionCat, ref),
+				fmt.Sprintf("connect container %s to network %s with alias %s", labels.OnionCat, ident, onionCatAlias(ident)))
+		}
+
+		var actions []string
+		if labels.Volume != "" {
+			actions = append(actions, fmt.Sprintf("create container %s from image %s with volume %s at %s", ident, ref, labels.Volume, HiddenServiceDir))
+		} else {
+			actions = append(actions, fmt.Sprintf("create container %s from image %s", ident, ref))
+		}
+		actions = append(actions, fmt.Sprintf("copy torrc into %s:%s", ident, TorrcPath))
+		if !options.Ephemeral {
+			files, err := describeFiles(cr.plan.services, options.Clients)
+			if err != nil {
+				return nil, err
+			}
+			if files != "" {
+				actions = append(actions, fmt.Sprintf("copy %s into %s:%s", files, ident, HiddenServiceDir))
+			}
+		}
+		actions = append(actions,
+			fmt.Sprintf("start container %s", ident),
+			fmt.Sprintf("connect container %s to network %s", ident, labels.NetworkName()))
+		add(cr.runTor, actions...)
+
+		if labels.Network != "" {
+			add(cr.checkReachable, fmt.Sprintf("check that container %s can reach %s", ident, labels.TargetName))
+		}
+
+		if options.Isolate {
+			actions := []string{fmt.Sprintf("redirect tcp and dns traffic from network %s to the TransPort and DNSPort of %s", ident, ident)}
+			for _, name := range labels.IsolatedFrom {
+				actions = append(actions, fmt.Sprintf("disconnect container %s from network %s", labels.TargetName, name))
+			}
+			actions = append(actions,
+				fmt.Sprintf("route all traffic of container %s through %s", labels.TargetName, ident),
+				fmt.Sprintf("use %s as the nameserver of container %s, and block docker's embedded resolver", ident, labels.TargetName),
+				fmt.Sprintf("check that container %s has no direct route", labels.TargetName))
+			add(cr.isolateTarget, actions...)
+		}
+	}
+
+	var actions []string
+	if options.Ephemeral {
+		for _, svc := range cr.plan.services {
+			actions = append(actions, fmt.Sprintf("add onion service for ports %s with ADD_ONION", formatPorts(cr.plan.servicePorts[svc.Name])))
+		}
+	}
+	add(cr.addOnions, actions...)
+
+	if options.OnionCat {
+		add(cr.configureOnionCat, fmt.Sprintf("copy %s into %s once the onion address is known, forwarding udp ports %s", path.Base(OnionCatConfigPath), labels.OnionCat, formatPorts(labels.UDPPorts)))
+	}
+	if options.PublishTimeout > 0 {
+		add(cr.waitForPublication, fmt.Sprintf("wait up to %s for the onion service descriptors to be published", options.PublishTimeout))
+	}
+
+	return steps, nil
+}
+
+// torServices returns the hidden services in the torrc of the Tor container.
+// For the shared Tor daemon, it is only the part of its torrc for this onion
+// service.
+func (cr *createRun) torServices() []TorService {
+	plan := cr.plan
+	if cr.options.Shared {
+		return []TorService{{
+			Dir:     path.Join(HiddenServiceDir, plan.ident),
+			Targets: GenerateTargetMappings(cr.addr, plan.servicePorts[""]),
+		}}
+	}
+
+	// Ephemeral onion services are added using the ControlPort once Tor is
+	// running, so they don't go in the torrc.
+	if cr.options.Ephemeral {
+		return nil
+	}
+
+	var torServices []TorService
+	for _, svc := range plan.services {
+		torServices = append(torServices, TorService{
+			Dir:     path.Join(HiddenServiceDir, hiddenServiceSubdir(svc.Name)),
+			Targets: GenerateTargetMappings(cr.addr, plan.servicePorts[svc.Name]),
+		})
+	}
+	if cr.options.OnionCat {
+		torServices[0].Targets = append(torServices[0].Targets, TargetIP{
+			Addr:         cr.onionCatAddr,
+			InternalPort: OnionCatPort,
+			ExternalPort: OnionCatPort,
+		})
+	}
+	return torServices
+}
+
+// torOptions returns the extra options in the torrc of the Tor container.
+func (cr *createRun) torOptions() map[string]string {
+	if cr.options.Shared {
+		return nil
+	}
+
+	torOptions := map[string]string{}
+	for key, value := range cr.options.TorOptions {
+		torOptions[key] = value
+	}
+	if cr.options.Isolate {
+		for key, value := range isolateTorOptions {
+			torOptions[key] = value
+		}
+	}
+	return torOptions
+}
+
+// watchControl connects to the ControlPort of the Tor container, so we see all
+// of the HS_DESC events. It has to be called before Tor can publish anything.
+func (cr *createRun) watchControl(containerID string) error {
+	if !cr.options.Ephemeral && cr.options.PublishTimeout <= 0 {
+		return nil
+	}
+
+	ctrl, err := DialControl(cr.cli, containerID)
+	if err == nil {
+		if err = ctrl.WatchDescriptors(); err != nil {
+			ctrl.Close()
+		}
+	}
+	if err != nil {
+		if cr.options.Ephemeral {
+			return fmt.Errorf("connecting to tor: %s", err)
+		}
+		log.Warnf("cannot connect to tor control port, not waiting for onion service to be published: %s", err)
+		return nil
+	}
+	cr.ctrl = ctrl
+	return nil
+}
+
+func (cr *createRun) createKeyVolume() error {
+	labels := cr.plan.labels
+	created, err := CreateKeyVolume(cr.cli, cr.txn, labels.Volume)
+	if err != nil {
+		return fmt.Errorf("creating key volume: %s", err)
+	}
+
+	// Keep using the keys in an existing volume, but never clobber them with
+	// different ones.
+	if !created {
+		// Reading the volume needs an image. Unless the onion service is
+		// added to the shared Tor daemon, the Tor image is about to be
+		// needed anyway, so it might as well be built now.
+		var imageID string
+		if !cr.options.Shared {
+			imageID, err = EnsureTorImage(cr.cli, cr.options.Image)
+			if err != nil {
+				return fmt.Errorf("getting image: %s", err)
+			}
+		}
+
+		services, err := VolumeKeys(cr.cli, labels.Volume, imageID, cr.plan.services)
+		if err != nil {
+			return fmt.Errorf("using existing key volume: %s", err)
+		}
+		cr.plan.setServices(services)
+	}
+	log.WithFields(log.Fields{
+		"volume":  labels.Volume,
+		"created": created,
+	}).Info("using persistent key volume")
+	return nil
+}
+
+// generateKeys generates any missing keys ourselves (rather than waiting for
+// Tor to generate them and write out the onion addresses), so we know the
+// onion addresses up front. Ephemeral onion services get their address from
+// ADD_ONION instead.
+func (cr *createRun) generateKeys() error {
+	services, err := generateMissingKeys(cr.plan.services)
+	if err != nil {
+		return err
+	}
+	cr.plan.setServices(services)
+	return nil
+}
+
+func (cr *createRun) createNetwork() error {
+	plan, options := cr.plan, cr.options
+
+	// Another mkonion might have taken the identifier since we checked it, in
+	// which case we pick another one (unless it was given to us).
+	var err error
+	for attempt := 1; ; attempt++ {
+		cr.networkID, err = CreateOnionNetwork(cr.cli, plan.ident, options.Network, options.Isolate, plan.labels.Labels())
+		if !isErrAlreadyExists(err) || options.Name != "" || attempt >= maxIdentifierAttempts {
+			break
+		}
+		log.WithFields(log.Fields{
+			"network": plan.ident,
+		}).Warn("onion network name already taken, picking another")
+
+		ident, err := NewIdentifier(cr.cli, "")
+		if err != nil {
+			return err
+		}
+		plan.rename(ident)
+	}
+	if err != nil {
+		return fmt.Errorf("creating onion network: %s", err)
+	}
+
+	networkID := cr.networkID
+	cr.txn.Add("network create", func() error {
+		return PurgeOnionNetwork(cr.cli, networkID)
+	})
+	log.WithFields(log.Fields{
+		"network": plan.ident,
+	}).Info("created onion network")
+	return nil
+}
+
+func (cr *createRun) connectTarget() error {
+	targetID, networkID := cr.plan.target.ID, cr.networkID
+	if err := ConnectOnionNetwork(cr.cli, targetID, networkID, targetAlias(cr.plan.ident)); err != nil {
+		return fmt.Errorf("connecting target to onion network: %s", err)
+	}
+	cr.txn.Add("target connect", func() error {
+		return cr.cli.NetworkDisconnect(networkID, targetID, true)
+	})
+	log.WithFields(log.Fields{
+		"network":   cr.plan.ident,
+		"container": cr.options.Target,
+	}).Info("attached container to onion network")
+	return nil
+}
+
+// useNetwork uses an existing network. It doesn't belong to us, so it is never
+// created or removed, and the target is already connected to it.
+func (cr *createRun) useNetwork() error {
+	cr.networkID = cr.plan.labels.NetworkName()
+	log.WithFields(log.Fields{
+		"network": cr.networkID,
+	}).Info("using existing network")
+	return nil
+}
+
+func (cr *createRun) findTarget() error {
+	ip, err := FindOnionIPAddress(cr.cli, cr.plan.target.ID, cr.networkID)
+	if err != nil {
+		return fmt.Errorf("finding target onion ip: %s", err)
+	}
+	cr.ip = ip
+	log.WithFields(log.Fields{
+		"network":   cr.networkID,
+		"container": cr.options.Target,
+		"ip":        ip,
+	}).Info("found target address")
+	return nil
+}
+
+// startSharedDaemon makes sure the shared Tor daemon is running. It has
+// already bootstrapped, so it publishes the descriptor as soon as it is
+// reloaded with the new onion service.
+func (cr *createRun) startSharedDaemon() error {
+	containerID, err := EnsureSharedDaemon(cr.cli, cr.options.Image)
+	if err != nil {
+		return fmt.Errorf("starting shared tor daemon: %s", err)
+	}
+	return cr.watchControl(containerID)
+}
+
+func (cr *createRun) addSharedService() error {
+	containerID, err := AddSharedService(cr.cli, cr.txn, cr.plan.ident, cr.networkID, cr.plan.services[0], cr.options.Clients, cr.options.Image)
+	if err != nil {
+		return fmt.Errorf("adding to shared tor daemon: %s", err)
+	}
+	cr.containerID = containerID
+	log.WithFields(log.Fields{
+		"container": containerID,
+	}).Infof("added onion service to shared tor daemon")
+	return nil
+}
+
+func (cr *createRun) ensureTorImage() error {
+	imageID, err := EnsureTorImage(cr.cli, cr.options.Image)
+	if err != nil {
+		return fmt.Errorf("getting image: %s", err)
+	}
+	cr.imageID = imageID
+
+	// Forward to the alias of the target if Tor can resolve it, so the onion
+	// service survives the target getting a new address.
+	resolves, err := imageResolvesAliases(cr.cli, imageID)
+	if err != nil {
+		return fmt.Errorf("inspecting image: %s", err)
+	}
+	cr.resolves = resolves
+	cr.addr = cr.ip
+	if resolves {
+		cr.addr = cr.plan.labels.TargetAlias()
+	}
+	return nil
+}
+
+func (cr *createRun) runOnionCat() error {
+	imageID, err := EnsureOnionCatImage(cr.cli)
+	if err != nil {
+		return fmt.Errorf("getting onioncat image: %s", err)
+	}
+	cr.onionCatID, err = RunOnionCat(cr.cli, cr.txn, cr.plan.ident, cr.networkID, imageID, cr.plan.labels.Labels())
+	if err != nil {
+		return fmt.Errorf("starting onioncat: %s", err)
+	}
+	log.WithFields(log.Fields{
+		"container": cr.onionCatID,
+	}).Info("onioncat started")
+
+	cr.onionCatAddr = onionCatAlias(cr.plan.ident)
+	if !cr.resolves {
+		cr.onionCatAddr, err = FindOnionIPAddress(cr.cli, cr.onionCatID, cr.networkID)
+		if err != nil {
+			return fmt.Errorf("finding onioncat onion ip: %s", err)
+		}
+	}
+	return nil
+}
+
+func (cr *createRun) runTor() error {
+	torrc, err := GenerateConfig(cr.cli, cr.torServices(), cr.torOptions())
+	if err != nil {
+		return fmt.Errorf("generating torrc: %s", err)
+	}
+	log.Info("generated torrc config")
+
+	// Ephemeral onion services don't have any files in the hidden_service
+	// directory.
+	services, clients := cr.plan.services, cr.options.Clients
+	if cr.options.Ephemeral {
+		services, clients = nil, nil
+	}
+
+	cr.containerID, err = FakeBuildRun(cr.cli, cr.txn, &FakeBuildOptions{
+		ident:     cr.plan.ident,
+		networkID: cr.networkID,
+		torrc:     torrc,
+		services:  services,
+		clients:   clients,
+		volume:    cr.plan.labels.Volume,
+		imageID:   cr.imageID,
+		labels:    cr.plan.labels.Labels(),
+	})
+	if err != nil {
+		return fmt.Errorf("starting tor daemon: %s", err)
+	}
+	log.WithFields(log.Fields{
+		"container": cr.containerID,
+	}).Infof("tor daemon started")
+
+	// XXX: Tor could publish a descriptor before we subscribe, in which case
+	//      we only see the next upload. WaitForPublication also checks
+	//      whether the descriptors can be fetched, so we don't wait forever
+	//      if that happens.
+	return cr.watchControl(cr.containerID)
+}
+
+// checkReachable makes sure Tor can actually reach the target. Nothing stops
+// the containers on a network we don't control from being unable to talk to
+// each other (with ICC disabled, for instance).
+func (cr *createRun) checkReachable() error {
+	ports := map[string]string{}
+	for _, svcPorts := range cr.plan.servicePorts {
+		for onion, container := range svcPorts {
+			ports[onion] = container
+		}
+	}
+
+	network := cr.plan.labels.Network
+	if err := CheckReachable(cr.cli, cr.containerID, cr.ip, ports); err != nil {
+		return fmt.Errorf("checking tor can reach target on network %s: %s", network, err)
+	}
+	log.WithFields(log.Fields{
+		"network": network,
+	}).Info("tor can reach target")
+	return nil
+}
+
+func (cr *createRun) isolateTarget() error {
+	if err := isolateTarget(cr.cli, cr.txn, cr.imageID, cr.plan.target, cr.containerID, cr.networkID, cr.plan.labels.IsolatedFrom); err != nil {
+		return fmt.Errorf("isolating target: %s", err)
+	}
+	log.WithFields(log.Fields{
+		"container": cr.options.Target,
+	}).Info("isolated target, its traffic goes through tor")
+	return nil
+}
+
+// addOnions fills in the result with the onion address of each service,
+// adding them with ADD_ONION if they are ephemeral.
+func (cr *createRun) addOnions() error {
+	plan := cr.plan
+	cr.result = &CreateResult{
+		Ident:       plan.ident,
+		Network:     plan.labels.NetworkName(),
+		NetworkID:   cr.networkID,
+		ContainerID: cr.containerID,
+		Target:      plan.labels.TargetName,
+		TargetIP:    cr.ip,
+	}
+
+	for _, svc := range plan.services {
+		// Every other onion service has a key by now, so we already know its
+		// address.
+		var onionAddr string
+		if cr.options.Ephemeral {
+			var err error
+			onionAddr, err = cr.ctrl.AddOnion(svc.Key, GenerateTargetMappings(cr.ip, plan.servicePorts[svc.Name]), cr.options.Clients)
+			if err != nil {
+				return fmt.Errorf("adding onion service: %s", err)
+			}
+			if svc.Key != nil && onionAddr != svc.Key.Hostname() {
+				return fmt.Errorf("tor is using onion address %s rather than %s", onionAddr, svc.Key.Hostname())
+			}
+		} else {
+			onionAddr = svc.Key.Hostname()
+		}
+		log.WithFields(log.Fields{
+			"service": svc.Name,
+			"onion":   onionAddr,
+		}).Infof("retrieved Tor onion address")
+		cr.onions = append(cr.onions, onionAddr)
+
+		if svc.Name == "" {
+			cr.result.Ports = plan.servicePorts[""]
+			cr.result.Onion = onionAddr
+		} else {
+			cr.result.Services = append(cr.result.Services, &ServiceResult{
+				Name:  svc.Name,
+				Ports: plan.servicePorts[svc.Name],
+				Onion: onionAddr,
+			})
+		}
+	}
+	return nil
+}
+
+func (cr *createRun) configureOnionCat() error {
+	udpPorts := cr.plan.labels.UDPPorts
+	address, err := ConfigureOnionCat(cr.cli, cr.onionCatID, cr.plan.ident, cr.result.Onion, udpPorts)
+	if err != nil {
+		return fmt.Errorf("configuring onioncat: %s", err)
+	}
+	cr.result.UDPPorts = udpPorts
+	cr.result.OnionCat = address
+	log.WithFields(log.Fields{
+		"address": address,
+		"ports":   formatPorts(udpPorts),
+	}).Info("onioncat is forwarding udp ports")
+	return nil
+}
+
+func (cr *createRun) waitForPublication() error {
+	if cr.ctrl == nil {
+		return nil
+	}
+	log.Infof("waiting up to %s for onion service descriptors to be published", cr.options.PublishTimeout)
+	return cr.ctrl.WaitForPublication(cr.onions, cr.options.PublishTimeout)
+}
+
+// CreateOnionService creates a new onion service for a target container. If
+// anything goes wrong (or we are interrupted), all of the changes made to the
+// daemon are rolled back.
+func CreateOnionService(cli *client.Client, options *CreateOptions) (result *CreateResult, err error) {
+	plan, err := planOnionService(cli, options)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &createRun{
+		cli:     cli,
+		options: options,
+		plan:    plan,
+	}
+	steps, err := cr.steps()
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything from here on modifies the state of the daemon, so make sure
+	// we undo it all if something goes wrong.
+	txn := NewTransaction()
+	defer txn.HandleSignals()()
+	defer func() {
+		if err != nil {
+			txn.Rollback()
+		} else {
+			txn.Commit()
+		}
+	}()
+	cr.txn = txn
+	defer func() {
+		if cr.ctrl != nil {
+			cr.ctrl.Close()
+		}
+	}()
+
+	if options.Shared {
+		// The shared daemon has to be reloaded once everything else has been
+		// rolled back, so that it forgets about the onion network.
+		txn.Add("shared daemon reload", func() error {
+			return ReloadSharedDaemon(cli)
+		})
+	}
+
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			return nil, err
+		}
+	}
+	return cr.result, nil
+}
@@ -0,0 +1,241 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/cyphar/mkonion/buildctx"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"gopkg.in/yaml.v2"
+)
+
+// With -dry-run, mkonion works out everything it would do to create an onion
+// service (only reading from the daemon) and prints it rather than doing it.
+// With -render-to, the build context of the Tor image is written to disk so it
+// can be built with `docker build`.
+
+// dryRunTargetIP stands in for the address of the target in the torrc, since
+// the target only gets an address on the onion network once it's connected.
+const dryRunTargetIP = "<target-ip>"
+
+// dryRunOnionCatIP is the same for the OnionCat container.
+const dryRunOnionCatIP = "<onioncat-ip>"
+
+// DryRun describes what creating an onion service would do.
+type DryRun struct {
+	Ident      string            `json:"ident" yaml:"ident"`
+	Target     string            `json:"target" yaml:"target"`
+	TargetID   string            `json:"target_id" yaml:"target_id"`
+	Labels     map[string]string `json:"labels" yaml:"labels"`
+	Actions    []string          `json:"actions" yaml:"actions"`
+	Dockerfile string            `json:"dockerfile,omitempty" yaml:"dockerfile,omitempty"`
+	Torrc      string            `json:"torrc" yaml:"torrc"`
+	// SharedTorrc is set if Torrc is only the part of the torrc of the shared
+	// Tor daemon for this onion service.
+	SharedTorrc bool `json:"shared_torrc,omitempty" yaml:"shared_torrc,omitempty"`
+}
+
+// planTorImage works out how the Tor image would be got, and returns its
+// reference, the action needed to get it and whether its entrypoint resolves
+// target aliases.
+func (cr *createRun) planTorImage() (string, string, bool, error) {
+	options := cr.options.Image
+	ref := options.Image
+	if ref == "" {
+		dockerfile, err := generateDockerfile(options)
+		if err != nil {
+			return "", "", false, fmt.Errorf("generating dockerfile: %s", err)
+		}
+		cr.dockerfile = dockerfile
+		ref = torImageTag(dockerfile)
+	}
+
+	inspect, _, err := cr.cli.ImageInspectWithRaw(ref, false)
+	if err == nil {
+		resolves := inspect.Config != nil && inspect.Config.Labels[LabelResolve] == "true"
+		return ref, "use existing image " + ref, resolves, nil
+	} else if !client.IsErrImageNotFound(err) {
+		return "", "", false, err
+	}
+
+	if options.Image != "" {
+		return ref, "pull image " + ref, false, nil
+	}
+	// Only the embedded Dockerfile is known to use the entrypoint.
+	return ref, "build image " + ref, options.Dockerfile == "", nil
+}
+
+// describeNetwork describes the network created by a NetworkCreate request.
+func describeNetwork(network types.NetworkCreate) string {
+	desc := network.Driver + " network " + network.Name
+	if network.Internal {
+		desc = "internal " + desc
+	}
+	var subnets []string
+	for _, config := range network.IPAM.Config {
+		subnet := config.Subnet
+		if config.Gateway != "" {
+			subnet += " (gateway " + config.Gateway + ")"
+		}
+		subnets = append(subnets, subnet)
+	}
+	if len(subnets) > 0 {
+		desc += " with subnet " + strings.Join(subnets, ", ")
+	}
+	if network.Options[enableIPv6Option] == "true" {
+		desc += " with IPv6"
+	}
+	return desc
+}
+
+// describeFiles describes the files copied into the hidden_service directory
+// for the given services. By the time they are copied every service has a key,
+// even if it hasn't been generated yet.
+func describeFiles(services []*ServiceOptions, clients map[string]string) (string, error) {
+	var paths []string
+	for _, svc := range services {
+		if svc.Key == nil {
+			copied := *svc
+			copied.Key = &OnionKey{}
+			svc = &copied
+		}
+		files, err := hiddenServiceFiles(svc, clients)
+		if err != nil {
+			return "", err
+		}
+		for _, file := range files {
+			paths = append(paths, file.Path)
+		}
+	}
+	sort.Strings(paths)
+	return strings.Join(paths, ", "), nil
+}
+
+// DryRunOnionService works out what CreateOnionService would do with the given
+// options, without changing anything. The actions are those of the steps
+// CreateOnionService would run.
+func DryRunOnionService(cli *client.Client, options *CreateOptions) (*DryRun, error) {
+	plan, err := planOnionService(cli, options)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &createRun{
+		cli:     cli,
+		options: options,
+		plan:    plan,
+	}
+	steps, err := cr.steps()
+	if err != nil {
+		return nil, err
+	}
+
+	dr := &DryRun{
+		Ident:       plan.ident,
+		Target:      plan.labels.TargetName,
+		TargetID:    plan.labels.Target,
+		Labels:      plan.labels.Labels(),
+		Dockerfile:  cr.dockerfile,
+		SharedTorrc: options.Shared,
+	}
+	for _, step := range steps {
+		dr.Actions = append(dr.Actions, step.actions...)
+	}
+
+	torrc, err := GenerateConfig(cli, cr.torServices(), cr.torOptions())
+	if err != nil {
+		return nil, fmt.Errorf("generating torrc: %s", err)
+	}
+	dr.Torrc = string(torrc)
+
+	return dr, nil
+}
+
+// Write writes a human-readable description of the dry run.
+func (dr *DryRun) Write(w io.Writer) error {
+	out := new(strings.Builder)
+
+	fmt.Fprintf(out, "# Onion service %s for %s (%s)\n\n", dr.Ident, dr.Target, dr.TargetID)
+
+	fmt.Fprintf(out, "# Actions\n")
+	for i, action := range dr.Actions {
+		fmt.Fprintf(out, "%d. %s\n", i+1, action)
+	}
+
+	fmt.Fprintf(out, "\n# Labels\n")
+	var keys []string
+	for key := range dr.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(out, "%s=%s\n", key, dr.Labels[key])
+	}
+
+	if dr.Dockerfile != "" {
+		fmt.Fprintf(out, "\n# Dockerfile\n%s\n", strings.TrimSpace(dr.Dockerfile))
+	}
+
+	if dr.SharedTorrc {
+		fmt.Fprintf(out, "\n# torrc (added to the torrc of %s)\n", SharedDaemonName)
+	} else {
+		fmt.Fprintf(out, "\n# torrc\n")
+	}
+	fmt.Fprintf(out, "%s\n", strings.TrimSpace(dr.Torrc))
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// WriteDryRun writes a dry run in the given format, which is the same as for
+// WriteResult. An empty format means the human-readable description.
+func WriteDryRun(w io.Writer, format string, dr *DryRun) error {
+	switch format {
+	case "":
+		return dr.Write(w)
+	case "json":
+		data, err := json.MarshalIndent(dr, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case "yaml":
+		data, err := yaml.Marshal(dr)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	return fmt.Errorf("cannot write a dry run in the %s format", format)
+}
+
+// RenderBuildContext writes the build context of the Tor image to a directory,
+// and returns the tag mkonion expects the image to have.
+func RenderBuildContext(options *ImageOptions, dir string) (string, error) {
+	if options.Image != "" {
+		return "", fmt.Errorf("cannot render the build context of an existing image")
+	}
+
+	dockerfile, err := generateDockerfile(options)
+	if err != nil {
+		return "", fmt.Errorf("generating dockerfile: %s", err)
+	}
+
+	if err := buildctx.WriteDir(dir, buildContextFiles(dockerfile)); err != nil {
+		return "", fmt.Errorf("writing build context: %s", err)
+	}
+	return torImageTag(dockerfile), nil
+}
@@ -9,13 +9,17 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"strings"
+	"io/ioutil"
+	"os"
+	"path"
 	"text/template"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/cyphar/mkonion/buildctx"
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 	containerTypes "github.com/docker/engine-api/types/container"
@@ -28,39 +32,67 @@ import (
 // have to touch the filesystem.
 
 const (
-	MkonionTag                = "mkonion/tor:latest"
+	// MkonionRepository is the repository used for the Tor image. The tag is
+	// derived from the contents of the Dockerfile, so the image only has to be
+	// built once and can be shared between all onion services.
+	MkonionRepository         = "mkonion/tor"
 	MkonionDockerfileTemplate = `
-	FROM alpine:3.4
-	RUN { \
-			echo '@edge http://dl-cdn.alpinelinux.org/alpine/edge/main'; \
-			echo '@edge http://dl-cdn.alpinelinux.org/alpine/edge/community';
-		} >> /etc/apk/repositories && \
-		apk update && \
-		apk upgrade && \
-	    apk add \
-			tor@testing && \
-		{{ if .HasKey }}
-		mkdir -p /var/lib/tor/hidden_service && \
-		chmod 600 /var/lib/tor/hidden_service && \
-		{{ end }}
-		rm -rf /var/cache/apk/*
-	COPY torrc /etc/tor/torrc
-	{{ if .HasKey }}
-	COPY private_key /var/lib/tor/hidden_service/private_key
-	{{ end }}
-	ENTRYPOINT ["/usr/bin/tor", "-f", "/etc/tor/torrc"]
+	FROM {{ .BaseImage }}
+	RUN apk add --no-cache \
+			tor{{ if .TorVersion }}={{ .TorVersion }}{{ end }} \
+			iptables && \
+		mkdir -p /etc/tor /var/lib/tor/hidden_service && \
+		chmod 700 /var/lib/tor/hidden_service
+	COPY mkonion-tor {{ .Entrypoint }}
+	ENTRYPOINT [{{ printf "%q" .Entrypoint }}]
+	LABEL {{ printf "%q" .VersionLabel }}={{ printf "%q" .Version }} \
+		{{ printf "%q" .ResolveLabel }}="true"
 	`
+
+	// DefaultBaseImage is the image the default Dockerfile builds on. It must
+	// be Alpine-based, since we use apk to install Tor.
+	DefaultBaseImage = "alpine:3.20"
+
+	// TorrcPath is where the torrc is copied into the Tor container.
+	TorrcPath = "/etc/tor/torrc"
 )
 
 var dockerfileTemplate = template.Must(template.New("dockerfile").Parse(MkonionDockerfileTemplate))
 
-func generateDockerfile(hasKey bool) (string, error) {
-	config := new(bytes.Buffer)
+func generateDockerfile(options *ImageOptions) (string, error) {
+	tmpl := dockerfileTemplate
+	if options.Dockerfile != "" {
+		data, err := ioutil.ReadFile(options.Dockerfile)
+		if err != nil {
+			return "", err
+		}
+
+		tmpl, err = template.New("dockerfile").Parse(string(data))
+		if err != nil {
+			return "", err
+		}
+	}
 
-	if err := dockerfileTemplate.Execute(config, struct {
-		HasKey bool
+	baseImage := options.BaseImage
+	if baseImage == "" {
+		baseImage = DefaultBaseImage
+	}
+
+	config := new(bytes.Buffer)
+	if err := tmpl.Execute(config, struct {
+		BaseImage    string
+		TorVersion   string
+		VersionLabel string
+		Version      string
+		ResolveLabel string
+		Entrypoint   string
 	}{
-		HasKey: hasKey,
+		BaseImage:    baseImage,
+		TorVersion:   options.TorVersion,
+		VersionLabel: LabelVersion,
+		Version:      Version,
+		ResolveLabel: LabelResolve,
+		Entrypoint:   EntrypointPath,
 	}); err != nil {
 		return "", err
 	}
@@ -68,47 +100,112 @@ func generateDockerfile(hasKey bool) (string, error) {
 	return config.String(), nil
 }
 
-func makeBuildContext(torrc []byte, privatekey []byte) (io.Reader, error) {
-	hasKey := len(privatekey) > 0
-	dockerfile, err := generateDockerfile(hasKey)
-	if err != nil {
-		return nil, err
-	}
+// torImageTag returns the content-addressed tag of the Tor image built from
+// the given Dockerfile and the entrypoint.
+func torImageTag(dockerfile string) string {
+	digest := sha256.Sum256([]byte(dockerfile + Entrypoint))
+	return MkonionRepository + ":" + hex.EncodeToString(digest[:])[:12]
+}
 
-	files := []*FakeFile{{
-		path: "torrc",
-		mode: 0644,
-		data: torrc,
+// buildContextFiles returns the files in the build context of the Tor image.
+// The context must never contain any secrets or per-service configuration, so
+// that the image can be shared. The entrypoint is always included, so custom
+// Dockerfiles can use it too.
+func buildContextFiles(dockerfile string) []*buildctx.Entry {
+	return []*buildctx.Entry{{
+		Path: "Dockerfile",
+		Mode: 0644,
+		Data: []byte(dockerfile),
 	}, {
-		path: "Dockerfile",
-		mode: 0644,
-		data: []byte(dockerfile),
+		Path: "mkonion-tor",
+		Mode: 0755,
+		Data: []byte(Entrypoint),
 	}}
+}
+
+// makeBuildContext creates the build context for the Tor image.
+func makeBuildContext(dockerfile string) (io.Reader, error) {
+	return buildctx.Archive(buildContextFiles(dockerfile))
+}
 
-	// XXX: This is probably slightly unsafe.
-	if hasKey {
-		files = append(files, &FakeFile{
-			path: "private_key",
-			mode: 0600,
-			data: privatekey,
+// copyFilesToContainer copies a set of files into a directory of a (created
+// but not yet started) container.
+func copyFilesToContainer(cli *client.Client, containerID, dir string, files []*buildctx.Entry) error {
+	archive, err := buildctx.Archive(files)
+	if err != nil {
+		return err
+	}
+
+	return cli.CopyToContainer(types.CopyToContainerOptions{
+		ContainerID: containerID,
+		Path:        dir,
+		Content:     archive,
+	})
+}
+
+// hiddenServiceFiles returns the files for the given onion service which are
+// copied into the hidden_service directory of a (created but not yet started)
+// Tor container. This way keys are only ever stored in the container's writable
+// layer, and never in an image.
+func hiddenServiceFiles(svc *ServiceOptions, clients map[string]string) ([]*buildctx.Entry, error) {
+	dir := hiddenServiceSubdir(svc.Name)
+
+	var files []*buildctx.Entry
+	if dir != "." {
+		// Tor refuses to use a HiddenServiceDir with loose permissions.
+		files = append(files, &buildctx.Entry{
+			Path: dir,
+			Mode: os.ModeDir | 0700,
 		})
 	}
 
-	return ArchiveContext(files)
+	if svc.Key != nil {
+		files = append(files, &buildctx.Entry{
+			Path: path.Join(dir, SecretKeyFile),
+			Mode: 0600,
+			Data: svc.Key.SecretKeyFile(),
+		}, &buildctx.Entry{
+			Path: path.Join(dir, PublicKeyFile),
+			Mode: 0600,
+			Data: svc.Key.PublicKeyFile(),
+		})
+	}
+
+	if len(clients) > 0 {
+		authFiles, err := authorizedClientFiles(clients)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range authFiles {
+			file.Path = path.Join(dir, file.Path)
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// copyTorrcToContainer copies the torrc into a (created but not yet started)
+// Tor container.
+func copyTorrcToContainer(cli *client.Client, containerID string, torrc []byte) error {
+	return copyFilesToContainer(cli, containerID, path.Dir(TorrcPath), []*buildctx.Entry{{
+		Path: path.Base(TorrcPath),
+		Mode: 0644,
+		Data: torrc,
+	}})
 }
 
-func buildTorImage(cli *client.Client, ctx io.Reader) (string, error) {
+func buildTorImage(cli *client.Client, tag string, ctx io.Reader) (string, error) {
 	// XXX: There's currently no way to get the image ID of a build without
 	//      manually parsing the output, or tagging the image. Since I'm not in
-	//      the mood for the former, we can tag the build with a random name.
-	//      Unfortunately, untagging of images isn't supported, so we'll have to
-	//      use a name that allows us to not pollute the host.
+	//      the mood for the former, we tag the build with its content-addressed
+	//      tag and then inspect it.
 
 	options := types.ImageBuildOptions{
 		// XXX: If we SuppressOutput we can get just the image ID, but we lose
 		//      being able to tell users what the status of the build is.
 		//SuppressOutput: true,
-		Tags:        []string{MkonionTag},
+		Tags:        []string{tag},
 		Remove:      true,
 		ForceRemove: true,
 		Dockerfile:  "Dockerfile",
@@ -123,97 +220,134 @@ func buildTorImage(cli *client.Client, ctx io.Reader) (string, error) {
 	// XXX: For some weird reason, at this point the build has not finished. We
 	//      need to wait for build.Body to be closed. We might as well tell the
 	//      user what the status of the build is.
-	log.Infof("building %s", MkonionTag)
-	dec := json.NewDecoder(build.Body)
-	for {
-		// Modified from pkg/jsonmessage in Docker.
-		type JSONMessage struct {
-			Stream string `json:"stream,omitempty"`
-			Status string `json:"status,omitempty"`
-		}
+	log.Infof("building %s", tag)
+	defer build.Body.Close()
+	if err := logJSONMessages(build.Body); err != nil {
+		return "", err
+	}
 
-		// Decode the JSONMessages.
-		var jm JSONMessage
-		if err := dec.Decode(&jm); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return "", err
-		}
+	inspect, _, err := cli.ImageInspectWithRaw(tag, false)
+	if err != nil {
+		return "", err
+	}
 
-		jm.Stream = strings.TrimSpace(jm.Stream)
-		jm.Status = strings.TrimSpace(jm.Status)
+	log.Infof("successfully built %s image", tag)
+	return inspect.ID, nil
+}
 
-		// Log the status.
-		if jm.Stream != "" {
-			log.Info(jm.Stream)
-		}
-		if jm.Status != "" {
-			log.Info(jm.Status)
-		}
+// EnsureTorImage makes sure that the Tor image exists, pulling or building it
+// if it doesn't. The image is never removed by rollbacks, as it doesn't contain
+// anything specific to an onion service and building it is expensive.
+func EnsureTorImage(cli *client.Client, options *ImageOptions) (string, error) {
+	if options.Image != "" {
+		return pullTorImage(cli, options.Image)
 	}
 
-	inspect, _, err := cli.ImageInspectWithRaw(MkonionTag, false)
+	dockerfile, err := generateDockerfile(options)
 	if err != nil {
-		// XXX: Should probably clean up the built image here?
+		return "", fmt.Errorf("generating dockerfile: %s", err)
+	}
+	tag := torImageTag(dockerfile)
+
+	if inspect, _, err := cli.ImageInspectWithRaw(tag, false); err == nil {
+		log.Infof("using existing %s image", tag)
+		return inspect.ID, nil
+	} else if !client.IsErrImageNotFound(err) {
 		return "", err
 	}
 
-	log.Infof("successfully built %s image", MkonionTag)
-	return inspect.ID, nil
+	ctx, err := makeBuildContext(dockerfile)
+	if err != nil {
+		return "", fmt.Errorf("making build context: %s", err)
+	}
+
+	return buildTorImage(cli, tag, ctx)
 }
 
-func runTorContainer(cli *client.Client, ident, imageID, network string) (string, error) {
+func runTorContainer(cli *client.Client, txn *Transaction, options *FakeBuildOptions) (string, error) {
 	config := &types.ContainerCreateConfig{
-		Name: ident,
+		Name: options.ident,
 		Config: &containerTypes.Config{
-			Image: imageID,
+			Image:  options.imageID,
+			Labels: options.labels,
 		},
+		HostConfig: &containerTypes.HostConfig{},
+	}
+
+	if options.volume != "" {
+		config.HostConfig.Binds = append(config.HostConfig.Binds, options.volume+":"+HiddenServiceDir)
 	}
 
 	resp, err := cli.ContainerCreate(config.Config, config.HostConfig, config.NetworkingConfig, config.Name)
 	if err != nil {
 		return "", err
 	}
-	// TODO: Remove container on failure.
+	txn.Add("container create", func() error {
+		return cli.ContainerRemove(types.ContainerRemoveOptions{
+			ContainerID:   resp.ID,
+			RemoveVolumes: true,
+			Force:         true,
+		})
+	})
 
 	for _, warning := range resp.Warnings {
 		log.Warn(warning)
 	}
 
+	if err := copyTorrcToContainer(cli, resp.ID, options.torrc); err != nil {
+		return "", fmt.Errorf("copying torrc: %s", err)
+	}
+
+	var files []*buildctx.Entry
+	for _, svc := range options.services {
+		svcFiles, err := hiddenServiceFiles(svc, options.clients)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, svcFiles...)
+	}
+	if len(files) > 0 {
+		if err := copyFilesToContainer(cli, resp.ID, HiddenServiceDir, files); err != nil {
+			return "", fmt.Errorf("copying hidden service files: %s", err)
+		}
+	}
+
 	if err := cli.ContainerStart(resp.ID); err != nil {
 		return "", err
 	}
+	txn.Add("container start", func() error {
+		return cli.ContainerStop(resp.ID, 10)
+	})
 
 	// Connect to the network.
-	if err := cli.NetworkConnect(network, resp.ID, nil); err != nil {
+	if err := cli.NetworkConnect(options.networkID, resp.ID, nil); err != nil {
 		return "", err
 	}
+	txn.Add("network connect", func() error {
+		return cli.NetworkDisconnect(options.networkID, resp.ID, true)
+	})
 
 	return resp.ID, err
 }
 
 type FakeBuildOptions struct {
-	ident      string
-	networkID  string
-	torrc      []byte
-	privatekey []byte
+	ident     string
+	networkID string
+	torrc     []byte
+	services  []*ServiceOptions
+	clients   map[string]string
+	volume    string
+	imageID   string
+	labels    map[string]string
 }
 
-// FakeBuildRun builds and starts a new mkonion tor server container entirely
-// in memory with no files created on the local machine.
-func FakeBuildRun(cli *client.Client, options *FakeBuildOptions) (string, error) {
-	ctx, err := makeBuildContext(options.torrc, options.privatekey)
-	if err != nil {
-		return "", fmt.Errorf("making build context: %s", err)
-	}
-
-	imageID, err := buildTorImage(cli, ctx)
-	if err != nil {
-		return "", fmt.Errorf("building image: %s", err)
-	}
-
-	containerID, err := runTorContainer(cli, options.ident, imageID, options.networkID)
+// FakeBuildRun starts a new mkonion tor server container from an image returned
+// by EnsureTorImage, entirely in memory with no files created on the local
+// machine. The configuration is copied into the container before it starts.
+// Every step is registered with the given transaction so it can be undone on
+// failure.
+func FakeBuildRun(cli *client.Client, txn *Transaction, options *FakeBuildOptions) (string, error) {
+	containerID, err := runTorContainer(cli, txn, options)
 	if err != nil {
 		return "", fmt.Errorf("starting container: %s", err)
 	}
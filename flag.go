@@ -8,6 +8,8 @@
 package main
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -21,3 +23,68 @@ func (fl *flagList) Set(field string) error {
 	*fl = append(*fl, field)
 	return nil
 }
+
+// optionMap is a repeatable flag of the form key=value.
+type optionMap map[string]string
+
+func (om *optionMap) String() string {
+	var pairs []string
+	for key, value := range *om {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return "[" + strings.Join(pairs, ", ") + "]"
+}
+
+func (om *optionMap) Set(field string) error {
+	parts := strings.SplitN(field, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("options must be of the form key=value")
+	}
+	if *om == nil {
+		*om = optionMap{}
+	}
+	(*om)[parts[0]] = parts[1]
+	return nil
+}
+
+// serviceList is a repeatable flag describing one of several onion services
+// for the same target, of the form
+// "name=NAME,port=[onion:]container[,port=...][,key=PATH]".
+type serviceList []*ServiceOptions
+
+func (sl *serviceList) String() string {
+	var names []string
+	for _, svc := range *sl {
+		names = append(names, svc.Name)
+	}
+	return "[" + strings.Join(names, ", ") + "]"
+}
+
+func (sl *serviceList) Set(field string) error {
+	svc := new(ServiceOptions)
+	for _, option := range strings.Split(field, ",") {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("service options must be of the form key=value")
+		}
+
+		switch key, value := parts[0], parts[1]; key {
+		case "name":
+			svc.Name = value
+		case "port":
+			svc.Mappings = append(svc.Mappings, value)
+		case "key":
+			key, err := LoadOnionKey(value)
+			if err != nil {
+				return err
+			}
+			svc.Key = key
+		default:
+			return fmt.Errorf("unknown service option '%s'", key)
+		}
+	}
+
+	*sl = append(*sl, svc)
+	return nil
+}
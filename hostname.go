@@ -12,67 +12,93 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"path"
 	"strings"
-	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 )
 
-const HostnamePath = "/var/lib/tor/hidden_service/hostname"
+const HiddenServiceDir = "/var/lib/tor/hidden_service"
+
+// hiddenServiceSubdir returns the directory of the named onion service,
+// relative to HiddenServiceDir. The default onion service (with an empty name)
+// uses HiddenServiceDir directly, while named services each get their own
+// subdirectory so that they can share a persistent volume.
+func hiddenServiceSubdir(service string) string {
+	if service == "" {
+		return "."
+	}
+	return service
+}
 
 func isRunning(state *types.ContainerState) bool {
 	return state.Running && !state.Dead
 }
 
-func GetOnionHostname(cli *client.Client, containerID string) (string, error) {
-	content, stat, err := cli.CopyFromContainer(containerID, HostnamePath)
-	// XXX: This isn't very pretty. But we need to wait until Tor generates
-	//      an .onion address, and there's not really any better way of
-	//      doing it.
-	for err != nil && strings.Contains(err.Error(), "no such file or directory") {
-		// Make sure the container hasn't died.
-		if inspect, err := cli.ContainerInspect(containerID); err != nil {
-			return "", fmt.Errorf("error inspecting container: %s", err)
-		} else if !isRunning(inspect.State) {
-			return "", fmt.Errorf("container died before the hostname was computed")
-		}
-
-		log.Warnf("tor onion hostname not found in container, retrying after a short nap...")
-		time.Sleep(500 * time.Millisecond)
+// readHiddenServiceFile reads a file from the directory of the given onion
+// service in the Tor container.
+func readHiddenServiceFile(cli *client.Client, containerID, service, name string) ([]byte, error) {
+	file := path.Join(HiddenServiceDir, hiddenServiceSubdir(service), name)
 
-		content, stat, err = cli.CopyFromContainer(containerID, HostnamePath)
-	}
+	content, stat, err := cli.CopyFromContainer(containerID, file)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer content.Close()
 
 	if stat.Mode.IsDir() {
-		return "", fmt.Errorf("hostname file is a directory")
+		return nil, fmt.Errorf("%s file is a directory", name)
 	}
 
 	tr := tar.NewReader(content)
-	hdr, err := tr.Next()
-	for err != io.EOF {
-		if err != nil {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return nil, err
+		}
 
 		// XXX: Maybe do filepath.Base()?
-		if hdr.Name != "hostname" {
+		if hdr.Name != name {
 			continue
 		}
 
-		data, err := ioutil.ReadAll(tr)
-		if err != nil {
-			return "", err
-		}
+		return ioutil.ReadAll(tr)
+	}
+
+	return nil, fmt.Errorf("%s file not in copied archive", name)
+}
+
+// GetOnionHostname gets the onion address of the given hidden service running
+// in the given Tor container. The address is checked against the public key of
+// the hidden service.
+func GetOnionHostname(cli *client.Client, containerID, service string) (string, error) {
+	data, err := readHiddenServiceFile(cli, containerID, service, HostnameFile)
+	if err != nil {
+		return "", err
+	}
+
+	hostname := strings.TrimSpace(string(data))
+	if !ValidOnionAddress(hostname) {
+		return "", fmt.Errorf("hostname '%s' is not a valid v3 onion address", hostname)
+	}
+
+	data, err = readHiddenServiceFile(cli, containerID, service, PublicKeyFile)
+	if err != nil {
+		return "", err
+	}
+
+	public, err := ParsePublicKey(data)
+	if err != nil {
+		return "", err
+	}
 
-		hostname := string(data)
-		return strings.TrimSpace(hostname), nil
+	if expected := OnionAddress(public); hostname != expected {
+		return "", fmt.Errorf("hostname '%s' does not match public key (expected '%s')", hostname, expected)
 	}
 
-	return "", fmt.Errorf("hostname file not in copied archive")
+	return hostname, nil
 }
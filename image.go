@@ -0,0 +1,237 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+)
+
+// The Tor image can come from several places. By default we build it from the
+// embedded Dockerfile, but users can also provide their own Dockerfile template
+// or an existing image. Whatever the source, the image has to follow the same
+// layout (see the README):
+//
+//   * Running the image with no arguments runs Tor with the config at
+//     TorrcPath (/etc/tor/torrc).
+//   * HiddenServiceDir (/var/lib/tor/hidden_service) exists, is mode 0700 and is
+//     owned by the user Tor runs as.
+
+// ImageOptions describes where to get the Tor image from.
+type ImageOptions struct {
+	// Image is an existing image reference, pulled if it isn't present.
+	Image string
+	// Dockerfile is the path to a Dockerfile template to build instead of
+	// the embedded one.
+	Dockerfile string
+	// BaseImage and TorVersion are passed to the Dockerfile template.
+	BaseImage  string
+	TorVersion string
+}
+
+// AddFlags adds the flags for configuring the image source. The defaults are
+// taken from the environment.
+func (options *ImageOptions) AddFlags(flags *flag.FlagSet) {
+	flags.StringVar(&options.Image, "image", os.Getenv("MKONION_IMAGE"), "use an existing Tor image rather than building one (default $MKONION_IMAGE)")
+	flags.StringVar(&options.Dockerfile, "dockerfile", os.Getenv("MKONION_DOCKERFILE"), "build the Tor image from the given Dockerfile template (default $MKONION_DOCKERFILE)")
+	flags.StringVar(&options.BaseImage, "base-image", os.Getenv("MKONION_BASE_IMAGE"), "base image used to build the Tor image (default $MKONION_BASE_IMAGE or "+DefaultBaseImage+")")
+	flags.StringVar(&options.TorVersion, "tor-version", os.Getenv("MKONION_TOR_VERSION"), "version of the tor package to install in the Tor image (default $MKONION_TOR_VERSION or latest)")
+}
+
+// Validate makes sure that the options don't conflict.
+func (options *ImageOptions) Validate() error {
+	if options.Image != "" && (options.Dockerfile != "" || options.BaseImage != "" || options.TorVersion != "") {
+		return fmt.Errorf("cannot specify an existing image as well as options to build one")
+	}
+	return nil
+}
+
+// DefaultImageOptions returns the image options as configured by the
+// environment, for commands which don't take image flags.
+func DefaultImageOptions() *ImageOptions {
+	return &ImageOptions{
+		Image:      os.Getenv("MKONION_IMAGE"),
+		Dockerfile: os.Getenv("MKONION_DOCKERFILE"),
+		BaseImage:  os.Getenv("MKONION_BASE_IMAGE"),
+		TorVersion: os.Getenv("MKONION_TOR_VERSION"),
+	}
+}
+
+// logJSONMessages logs the stream of JSON messages returned by the daemon when
+// building or pulling an image, and returns any error contained in the stream.
+func logJSONMessages(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		// Modified from pkg/jsonmessage in Docker.
+		type JSONMessage struct {
+			Stream string `json:"stream,omitempty"`
+			Status string `json:"status,omitempty"`
+			ID     string `json:"id,omitempty"`
+			Error  string `json:"error,omitempty"`
+		}
+
+		// Decode the JSONMessages.
+		var jm JSONMessage
+		if err := dec.Decode(&jm); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		if jm.Error != "" {
+			return fmt.Errorf("%s", jm.Error)
+		}
+
+		jm.Stream = strings.TrimSpace(jm.Stream)
+		jm.Status = strings.TrimSpace(jm.Status)
+
+		// Log the status.
+		if jm.Stream != "" {
+			log.Info(jm.Stream)
+		}
+		if jm.Status != "" {
+			if jm.ID != "" {
+				jm.Status = jm.ID + ": " + jm.Status
+			}
+			log.Info(jm.Status)
+		}
+	}
+	return nil
+}
+
+// splitReference splits an image reference into the repository, the tag and
+// the registry it lives on. Digest references are returned as-is without a
+// tag.
+func splitReference(ref string) (repo, tag, registry string) {
+	repo = ref
+	if !strings.Contains(ref, "@") {
+		tag = "latest"
+		if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+			repo, tag = ref[:i], ref[i+1:]
+		}
+	}
+
+	// Same heuristic as Docker: the first component is a registry if it
+	// looks like a hostname.
+	registry = "https://index.docker.io/v1/"
+	if i := strings.Index(repo, "/"); i >= 0 {
+		host := repo[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			registry = host
+		}
+	}
+	return
+}
+
+// registryAuth returns the base64-encoded credentials for the given registry,
+// as stored in the Docker client configuration by `docker login`. If there are
+// no credentials, an empty string is returned.
+func registryAuth(registry string) (string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("parsing docker config: %s", err)
+	}
+
+	entry, ok := config.Auths[registry]
+	if !ok {
+		// Entries are sometimes stored as URLs.
+		entry, ok = config.Auths["https://"+registry]
+	}
+	if !ok || entry.Auth == "" {
+		return "", nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return "", fmt.Errorf("decoding credentials for %s: %s", registry, err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid credentials for %s", registry)
+	}
+
+	auth, err := json.Marshal(types.AuthConfig{
+		Username:      parts[0],
+		Password:      parts[1],
+		ServerAddress: registry,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(auth), nil
+}
+
+// pullTorImage makes sure the given image exists locally, pulling it if it
+// doesn't.
+func pullTorImage(cli *client.Client, ref string) (string, error) {
+	if inspect, _, err := cli.ImageInspectWithRaw(ref, false); err == nil {
+		log.Infof("using existing %s image", ref)
+		return inspect.ID, nil
+	} else if !client.IsErrImageNotFound(err) {
+		return "", err
+	}
+
+	repo, tag, registry := splitReference(ref)
+	auth, err := registryAuth(registry)
+	if err != nil {
+		return "", fmt.Errorf("getting registry credentials: %s", err)
+	}
+
+	log.Infof("pulling %s", ref)
+	pull, err := cli.ImagePull(types.ImagePullOptions{
+		ImageID:      repo,
+		Tag:          tag,
+		RegistryAuth: auth,
+	}, func() (string, error) {
+		return "", fmt.Errorf("unauthorized to pull %s, run `docker login %s`", ref, registry)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer pull.Close()
+
+	if err := logJSONMessages(pull); err != nil {
+		return "", err
+	}
+
+	inspect, _, err := cli.ImageInspectWithRaw(ref, false)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("successfully pulled %s image", ref)
+	return inspect.ID, nil
+}
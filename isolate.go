@@ -0,0 +1,437 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	containerTypes "github.com/docker/engine-api/types/container"
+	networkTypes "github.com/docker/engine-api/types/network"
+	"github.com/docker/engine-api/types/strslice"
+)
+
+// An onion service only hides the target from people connecting to it. If the
+// target is compromised, it can still reveal the address of the host by making
+// a connection to the outside world. In isolated mode:
+//
+//   * The onion network is internal, so it has no route to the outside world.
+//   * The target is disconnected from every other network, and its default
+//     route points at the Tor container.
+//   * Tor runs a TransPort and DNSPort, and the Tor container redirects all
+//     TCP and DNS traffic from the onion network to them. Everything else is
+//     dropped.
+//   * The resolv.conf of the target is rewritten to use the Tor container as
+//     its nameserver, and the target rejects all traffic to Docker's embedded
+//     resolver (127.0.0.11). The embedded resolver lives in the network
+//     namespace of the target and can forward queries from the host, so the
+//     redirect in the Tor container would never see them.
+//
+// The Tor container itself stays on the default bridge network, which is how
+// it reaches the Tor network. Routes and firewall rules are set up by short
+// lived helper containers (using the Tor image, which has ip and iptables)
+// which share the network namespace of the target or the Tor container, so
+// neither of them needs NET_ADMIN.
+//
+// XXX: Routes and firewall rules don't survive a container being restarted.
+//      If that happens, the target has no default route (so nothing leaks),
+//      and `mkonion watch` sets everything up again. Docker keeps a modified
+//      resolv.conf when the target restarts, but a recreated target gets a
+//      new one which uses the embedded resolver again, so its DNS queries can
+//      leak until `mkonion watch` has isolated it again.
+
+const (
+	// TransPort and DNSPort are the ports Tor listens on for the traffic of
+	// an isolated target.
+	TransPort = "9040"
+	DNSPort   = "5353"
+)
+
+// isolateTorOptions are the torrc options needed to route the traffic of an
+// isolated target through Tor.
+var isolateTorOptions = map[string]string{
+	"TransPort":              "0.0.0.0:" + TransPort,
+	"DNSPort":                "0.0.0.0:" + DNSPort,
+	"VirtualAddrNetworkIPv4": "10.192.0.0/10",
+	"AutomapHostsOnResolve":  "1",
+}
+
+// EmbeddedResolver is the address of Docker's embedded DNS resolver inside
+// containers on user-defined networks.
+const EmbeddedResolver = "127.0.0.11"
+
+// targetResolvConf is where the resolv.conf of the target is mounted in netns
+// helper containers.
+const targetResolvConf = "/mnt/resolv.conf"
+
+// resolvConfMarker prefixes the lines of a resolv.conf which were commented
+// out when the target was isolated, so that they can be restored later.
+const resolvConfMarker = "#mkonion "
+
+// runNetnsHelper runs a shell script in a short-lived container sharing the
+// network namespace of another container, with NET_ADMIN and the given bind
+// mounts.
+func runNetnsHelper(cli *client.Client, imageID, containerID, script string, binds ...string) error {
+	resp, err := cli.ContainerCreate(&containerTypes.Config{
+		Image:      imageID,
+		Entrypoint: strslice.New("/bin/sh", "-c", script),
+		Labels: map[string]string{
+			LabelVersion: Version,
+		},
+	}, &containerTypes.HostConfig{
+		NetworkMode: containerTypes.NetworkMode("container:" + containerID),
+		CapAdd:      strslice.New("NET_ADMIN"),
+		Binds:       binds,
+	}, nil, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cli.ContainerRemove(types.ContainerRemoveOptions{
+			ContainerID: resp.ID,
+			Force:       true,
+		}); err != nil {
+			log.Warnf("removing helper container: %s", err)
+		}
+	}()
+
+	if err := cli.ContainerStart(resp.ID); err != nil {
+		return err
+	}
+
+	status, err := cli.ContainerWait(resp.ID)
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("helper container exited with status %d", status)
+	}
+	return nil
+}
+
+// networkSubnets returns the subnets of a network.
+func networkSubnets(cli *client.Client, network string) ([]string, error) {
+	inspect, err := cli.NetworkInspect(network)
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []string
+	for _, config := range inspect.IPAM.Config {
+		if config.Subnet != "" {
+			subnets = append(subnets, config.Subnet)
+		}
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("network %s has no subnets", network)
+	}
+	return subnets, nil
+}
+
+// SetupTransparentProxy redirects all TCP traffic from the onion network
+// (other than traffic for the Tor container itself) and all DNS traffic from
+// the onion network (including queries for the Tor container, which is the
+// nameserver of isolated targets) to the TransPort and DNSPort of the Tor
+// container, and drops everything else. It is safe to run more than once.
+func SetupTransparentProxy(cli *client.Client, imageID, torContainerID, network string) error {
+	torIP, err := FindOnionIPAddress(cli, torContainerID, network)
+	if err != nil {
+		return fmt.Errorf("finding tor onion ip: %s", err)
+	}
+	subnets, err := networkSubnets(cli, network)
+	if err != nil {
+		return err
+	}
+
+	script := []string{`add() { table="$1"; shift; iptables -t "$table" -C "$@" 2>/dev/null || iptables -t "$table" -A "$@"; }`}
+	for _, subnet := range subnets {
+		script = append(script,
+			fmt.Sprintf("add nat PREROUTING -s %s ! -d %s -p tcp -j REDIRECT --to-ports %s", subnet, torIP, TransPort),
+			fmt.Sprintf("add nat PREROUTING -s %s -p udp --dport 53 -j REDIRECT --to-ports %s", subnet, DNSPort),
+			fmt.Sprintf("add filter FORWARD -s %s -j DROP", subnet))
+	}
+
+	return runNetnsHelper(cli, imageID, torContainerID, strings.Join(script, " && "))
+}
+
+// targetResolvConfBind returns the bind mount of the resolv.conf of the target
+// into netns helper containers.
+func targetResolvConfBind(cli *client.Client, targetID string) (string, error) {
+	target, err := cli.ContainerInspect(targetID)
+	if err != nil {
+		return "", err
+	}
+	if target.ResolvConfPath == "" {
+		return "", fmt.Errorf("target has no resolv.conf")
+	}
+	return target.ResolvConfPath + ":" + targetResolvConf, nil
+}
+
+// RouteThroughTor makes the Tor container the default route and nameserver of
+// the target, and rejects all traffic from the target to Docker's embedded
+// resolver. It is safe to run more than once.
+func RouteThroughTor(cli *client.Client, imageID, targetID, torContainerID, network string) error {
+	torIP, err := FindOnionIPAddress(cli, torContainerID, network)
+	if err != nil {
+		return fmt.Errorf("finding tor onion ip: %s", err)
+	}
+	bind, err := targetResolvConfBind(cli, targetID)
+	if err != nil {
+		return err
+	}
+
+	// The original nameservers are commented out the first time around, and
+	// the nameserver we added is replaced after that (the Tor container might
+	// have a new address). The resolv.conf is a bind mount, so it has to be
+	// rewritten in place.
+	script := []string{
+		"ip route replace default via " + torIP,
+		fmt.Sprintf("{ iptables -C OUTPUT -d %s -j REJECT 2>/dev/null || iptables -I OUTPUT -d %s -j REJECT; }", EmbeddedResolver, EmbeddedResolver),
+		fmt.Sprintf(`{ if grep -q '^%s' %s; then grep -v '^nameserver' %s; else echo '%sisolated'; sed 's/^nameserver/%snameserver/' %s; fi; echo "nameserver %s"; } >/tmp/resolv.conf`,
+			resolvConfMarker, targetResolvConf, targetResolvConf, resolvConfMarker, resolvConfMarker, targetResolvConf, torIP),
+		fmt.Sprintf("cat /tmp/resolv.conf >%s", targetResolvConf),
+	}
+	return runNetnsHelper(cli, imageID, targetID, strings.Join(script, " && "), bind)
+}
+
+// RestoreTargetDNS undoes the DNS changes RouteThroughTor made to the target,
+// so that it uses its original nameservers again. A recreated target has a
+// fresh resolv.conf, which is left alone.
+func RestoreTargetDNS(cli *client.Client, imageID, targetID string) error {
+	bind, err := targetResolvConfBind(cli, targetID)
+	if err != nil {
+		return err
+	}
+
+	script := []string{
+		fmt.Sprintf("while iptables -D OUTPUT -d %s -j REJECT 2>/dev/null; do :; done", EmbeddedResolver),
+		fmt.Sprintf("if ! grep -q '^%s' %s; then exit 0; fi", resolvConfMarker, targetResolvConf),
+		fmt.Sprintf(`grep -v -e '^nameserver' -e '^%sisolated$' %s | sed 's/^%snameserver/nameserver/' >/tmp/resolv.conf`,
+			resolvConfMarker, targetResolvConf, resolvConfMarker),
+		fmt.Sprintf("cat /tmp/resolv.conf >%s", targetResolvConf),
+	}
+	return runNetnsHelper(cli, imageID, targetID, strings.Join(script[:2], "; ")+"; "+strings.Join(script[2:], " && "), bind)
+}
+
+// CheckIsolation makes sure that the target has no direct route to the outside
+// world: it must only be connected to internal networks, its only default
+// route must go through the Tor container, and its DNS queries must only go
+// to the Tor container.
+func CheckIsolation(cli *client.Client, imageID, targetID, torContainerID, network string) error {
+	target, err := cli.ContainerInspect(targetID)
+	if err != nil {
+		return err
+	}
+	if target.NetworkSettings == nil {
+		return fmt.Errorf("inspect container: network settings not available")
+	}
+
+	for name := range target.NetworkSettings.Networks {
+		inspect, err := cli.NetworkInspect(name)
+		if err != nil {
+			return err
+		}
+		if !inspect.Internal {
+			return fmt.Errorf("target is still connected to network %s", name)
+		}
+	}
+
+	torIP, err := FindOnionIPAddress(cli, torContainerID, network)
+	if err != nil {
+		return fmt.Errorf("finding tor onion ip: %s", err)
+	}
+
+	script := fmt.Sprintf(`test "$(ip -4 route show default | wc -l)" -eq 1 && `+
+		`ip -4 route show default | grep -q "via %s " && `+
+		`test -z "$(ip -6 route show default 2>/dev/null)"`, torIP)
+	if err := runNetnsHelper(cli, imageID, targetID, script); err != nil {
+		return fmt.Errorf("target has a default route which doesn't go through tor: %s", err)
+	}
+
+	bind, err := targetResolvConfBind(cli, targetID)
+	if err != nil {
+		return err
+	}
+	script = fmt.Sprintf(`iptables -C OUTPUT -d %s -j REJECT && `+
+		`grep -q '^nameserver' %s && `+
+		`! grep '^nameserver' %s | grep -qv "^nameserver %s$"`, EmbeddedResolver, targetResolvConf, targetResolvConf, torIP)
+	if err := runNetnsHelper(cli, imageID, targetID, script, bind); err != nil {
+		return fmt.Errorf("target can send dns queries which don't go through tor: %s", err)
+	}
+	return nil
+}
+
+// isolatedNetworks returns the networks the target has to be disconnected from
+// to isolate it.
+func isolatedNetworks(target types.ContainerJSON) ([]string, error) {
+	if target.HostConfig != nil {
+		mode := string(target.HostConfig.NetworkMode)
+		if mode == "host" || strings.HasPrefix(mode, "container:") {
+			return nil, fmt.Errorf("cannot isolate a container using --net=%s", mode)
+		}
+	}
+	if target.NetworkSettings == nil {
+		return nil, fmt.Errorf("inspect container: network settings not available")
+	}
+
+	var networks []string
+	for name := range target.NetworkSettings.Networks {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+	return networks, nil
+}
+
+// replaceIsolation adjusts the networks an isolated target is disconnected
+// from when the onion service replaces others. Their onion networks are about
+// to be removed, so they aren't networks of the target. If they isolated the
+// target, they have already disconnected it from its own networks, which it
+// has to be given back once the new onion service is removed.
+func replaceIsolation(networks []string, replaces []*OnionService) []string {
+	skip := map[string]bool{}
+	for _, svc := range replaces {
+		if !svc.Reused {
+			skip[svc.Ident] = true
+		}
+	}
+
+	var result []string
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !skip[name] && !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	for _, name := range networks {
+		add(name)
+	}
+	for _, svc := range replaces {
+		if svc.Labels != nil && svc.Labels.Isolate {
+			for _, name := range svc.Labels.IsolatedFrom {
+				add(name)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// isolatedAliases returns the aliases the target has on each of the networks
+// it is disconnected from, so that they can be given back along with the
+// networks. Networks which a replaced onion service already disconnected the
+// target from keep the aliases it recorded.
+func isolatedAliases(target types.ContainerJSON, networks []string, replaces []*OnionService) map[string][]string {
+	result := map[string][]string{}
+	for _, svc := range replaces {
+		if svc.Labels != nil && svc.Labels.Isolate {
+			for name, aliases := range svc.Labels.IsolatedAliases {
+				result[name] = aliases
+			}
+		}
+	}
+
+	for _, name := range networks {
+		endpoint := target.NetworkSettings.Networks[name]
+		if endpoint == nil {
+			continue
+		}
+		// Docker gives every container its short ID as an alias, which a
+		// recreated target wouldn't have.
+		var aliases []string
+		for _, alias := range endpoint.Aliases {
+			if !strings.HasPrefix(target.ID, alias) {
+				aliases = append(aliases, alias)
+			}
+		}
+		result[name] = aliases
+	}
+
+	for name, aliases := range result {
+		if len(aliases) == 0 {
+			delete(result, name)
+		}
+	}
+	return result
+}
+
+// DisconnectTarget disconnects the target from the given networks. Every step
+// is registered with the given transaction (if any), so the target is
+// reconnected (with the same aliases) on failure.
+func DisconnectTarget(cli *client.Client, txn *Transaction, target types.ContainerJSON, networks []string) error {
+	for _, name := range networks {
+		var aliases []string
+		if endpoint := target.NetworkSettings.Networks[name]; endpoint != nil {
+			aliases = endpoint.Aliases
+		}
+
+		log.WithFields(log.Fields{
+			"network":   name,
+			"container": target.ID,
+		}).Info("disconnecting target from network")
+		if err := cli.NetworkDisconnect(name, target.ID, false); err != nil {
+			return fmt.Errorf("disconnecting target from %s: %s", name, err)
+		}
+
+		if txn == nil {
+			continue
+		}
+		name := name
+		txn.Add("target disconnect", func() error {
+			return cli.NetworkConnect(name, target.ID, &networkTypes.EndpointSettings{
+				Aliases: aliases,
+			})
+		})
+	}
+	return nil
+}
+
+// isolateTarget routes all of the traffic of the target through the Tor
+// container (which must already be connected to the onion network), and
+// disconnects it from the given networks. Every step is registered with the
+// given transaction.
+func isolateTarget(cli *client.Client, txn *Transaction, imageID string, target types.ContainerJSON, torContainerID, network string, networks []string) error {
+	if err := SetupTransparentProxy(cli, imageID, torContainerID, network); err != nil {
+		return fmt.Errorf("setting up transparent proxy: %s", err)
+	}
+	if err := DisconnectTarget(cli, txn, target, networks); err != nil {
+		return err
+	}
+	txn.Add("target dns", func() error {
+		return RestoreTargetDNS(cli, imageID, target.ID)
+	})
+	if err := RouteThroughTor(cli, imageID, target.ID, torContainerID, network); err != nil {
+		return fmt.Errorf("routing target through tor: %s", err)
+	}
+	return CheckIsolation(cli, imageID, target.ID, torContainerID, network)
+}
+
+// ReconnectTarget reconnects a target to the networks it was disconnected
+// from when it was isolated. Errors are logged, so that as many networks as
+// possible are reconnected.
+func ReconnectTarget(cli *client.Client, labels *ServiceLabels) {
+	for _, name := range labels.IsolatedFrom {
+		log.WithFields(log.Fields{
+			"network":   name,
+			"container": labels.TargetRef(),
+		}).Info("reconnecting target to network")
+		var endpoint *networkTypes.EndpointSettings
+		if aliases := labels.IsolatedAliases[name]; len(aliases) > 0 {
+			endpoint = &networkTypes.EndpointSettings{
+				Aliases: aliases,
+			}
+		}
+		if err := cli.NetworkConnect(name, labels.TargetRef(), endpoint); err != nil {
+			log.Warnf("reconnecting target to %s: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Version 3 onion services use ed25519 keys, which Tor stores on-disk as a
+// fixed 32-byte header followed by the raw key material. Annoyingly, the secret
+// key is stored in its "expanded" form (the clamped scalar followed by the hash
+// prefix) rather than as a seed, so we can't use crypto/ed25519 to derive the
+// public key from it.
+
+const (
+	SecretKeyFile = "hs_ed25519_secret_key"
+	PublicKeyFile = "hs_ed25519_public_key"
+	HostnameFile  = "hostname"
+
+	secretKeyHeader = "== ed25519v1-secret: type0 ==\x00\x00\x00"
+	publicKeyHeader = "== ed25519v1-public: type0 ==\x00\x00\x00"
+
+	secretKeySize = 64
+	publicKeySize = 32
+
+	onionVersion    = 3
+	onionChecksum   = ".onion checksum"
+	onionAddressLen = 56
+)
+
+// OnionKey is the keypair of a version 3 onion service.
+type OnionKey struct {
+	// Secret is the expanded ed25519 secret key.
+	Secret []byte
+	// Public is the ed25519 public key.
+	Public []byte
+}
+
+// ParseSecretKey parses the contents of a hs_ed25519_secret_key file, and
+// derives the corresponding public key.
+func ParseSecretKey(data []byte) (*OnionKey, error) {
+	if !bytes.HasPrefix(data, []byte(secretKeyHeader)) {
+		return nil, fmt.Errorf("secret key does not have a v3 ed25519 header")
+	}
+
+	secret := data[len(secretKeyHeader):]
+	if len(secret) != secretKeySize {
+		return nil, fmt.Errorf("secret key has wrong length: expected %d bytes, got %d", secretKeySize, len(secret))
+	}
+
+	return &OnionKey{
+		Secret: append([]byte(nil), secret...),
+		Public: scalarBaseMult(secret[:32]),
+	}, nil
+}
+
+// ParsePublicKey parses the contents of a hs_ed25519_public_key file.
+func ParsePublicKey(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(publicKeyHeader)) {
+		return nil, fmt.Errorf("public key does not have a v3 ed25519 header")
+	}
+
+	public := data[len(publicKeyHeader):]
+	if len(public) != publicKeySize {
+		return nil, fmt.Errorf("public key has wrong length: expected %d bytes, got %d", publicKeySize, len(public))
+	}
+
+	return append([]byte(nil), public...), nil
+}
+
+// SecretKeyFile returns the contents of the hs_ed25519_secret_key file.
+func (k *OnionKey) SecretKeyFile() []byte {
+	return append([]byte(secretKeyHeader), k.Secret...)
+}
+
+// PublicKeyFile returns the contents of the hs_ed25519_public_key file.
+func (k *OnionKey) PublicKeyFile() []byte {
+	return append([]byte(publicKeyHeader), k.Public...)
+}
+
+// Hostname returns the onion address of the keypair.
+func (k *OnionKey) Hostname() string {
+	return OnionAddress(k.Public)
+}
+
+// OnionAddress computes the onion address for an ed25519 public key, as
+// described in section 6 of rend-spec-v3.txt:
+//
+//	onion_address = base32(PUBKEY | CHECKSUM | VERSION) + ".onion"
+//	CHECKSUM = H(".onion checksum" | PUBKEY | VERSION)[:2]
+func OnionAddress(public []byte) string {
+	version := []byte{onionVersion}
+
+	h := sha3.New256()
+	h.Write([]byte(onionChecksum))
+	h.Write(public)
+	h.Write(version)
+	checksum := h.Sum(nil)[:2]
+
+	var raw []byte
+	raw = append(raw, public...)
+	raw = append(raw, checksum...)
+	raw = append(raw, version...)
+
+	addr := base32.StdEncoding.EncodeToString(raw)
+	return strings.ToLower(addr) + ".onion"
+}
+
+// ValidOnionAddress returns whether the given string looks like a version 3
+// onion address.
+func ValidOnionAddress(addr string) bool {
+	name := strings.TrimSuffix(addr, ".onion")
+	if name == addr || len(name) != onionAddressLen {
+		return false
+	}
+
+	raw, err := base32.StdEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil || len(raw) != publicKeySize+3 {
+		return false
+	}
+
+	return OnionAddress(raw[:publicKeySize]) == addr
+}
+
+// The following is a minimal (and slow) implementation of ed25519 scalar
+// multiplication using affine coordinates on the twisted Edwards curve
+// -x^2 + y^2 = 1 + d x^2 y^2. It is only used to derive a single public key
+// from an expanded secret key, so performance doesn't matter.
+
+var (
+	edP  = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	edD  = new(big.Int).Mod(new(big.Int).Mul(big.NewInt(-121665), new(big.Int).ModInverse(big.NewInt(121666), edP)), edP)
+	edBx = bigFromString("15112221349535400772501151409588531511454012693041857206046113283949847762202")
+	edBy = bigFromString("46316835694926478169428394003475163141307993866256225615783033603165251855960")
+)
+
+func bigFromString(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid big integer constant: " + s)
+	}
+	return n
+}
+
+func edAdd(x1, y1, x2, y2 *big.Int) (*big.Int, *big.Int) {
+	x1y2 := new(big.Int).Mul(x1, y2)
+	y1x2 := new(big.Int).Mul(y1, x2)
+	x1x2 := new(big.Int).Mul(x1, x2)
+	y1y2 := new(big.Int).Mul(y1, y2)
+
+	dxy := new(big.Int).Mul(edD, x1x2)
+	dxy.Mul(dxy, y1y2)
+	dxy.Mod(dxy, edP)
+
+	xNum := new(big.Int).Add(x1y2, y1x2)
+	xDen := new(big.Int).Add(big.NewInt(1), dxy)
+	yNum := new(big.Int).Add(y1y2, x1x2)
+	yDen := new(big.Int).Sub(big.NewInt(1), dxy)
+
+	x3 := xNum.Mul(xNum, xDen.ModInverse(xDen.Mod(xDen, edP), edP))
+	y3 := yNum.Mul(yNum, yDen.ModInverse(yDen.Mod(yDen, edP), edP))
+	return x3.Mod(x3, edP), y3.Mod(y3, edP)
+}
+
+// scalarBaseMult computes the encoded point a*B for a little-endian scalar.
+func scalarBaseMult(scalar []byte) []byte {
+	// Convert from little-endian.
+	be := make([]byte, len(scalar))
+	for i, b := range scalar {
+		be[len(scalar)-1-i] = b
+	}
+	a := new(big.Int).SetBytes(be)
+
+	x, y := big.NewInt(0), big.NewInt(1)
+	bx, by := new(big.Int).Set(edBx), new(big.Int).Set(edBy)
+	for i := 0; i < a.BitLen(); i++ {
+		if a.Bit(i) == 1 {
+			x, y = edAdd(x, y, bx, by)
+		}
+		bx, by = edAdd(bx, by, bx, by)
+	}
+
+	// The encoding is the little-endian y coordinate, with the top bit set
+	// to the sign of x.
+	out := make([]byte, 32)
+	yb := y.Bytes()
+	for i, b := range yb {
+		out[len(yb)-1-i] = b
+	}
+	out[31] |= byte(x.Bit(0) << 7)
+	return out
+}
@@ -0,0 +1,223 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const onionAlphabet = "abcdefghijklmnopqrstuvwxyz234567"
+
+var onionEncoding = base32.NewEncoding(onionAlphabet).WithPadding(base32.NoPadding)
+
+// GenerateOnionKey generates a new v3 onion service keypair, in the same way
+// that Tor does.
+func GenerateOnionKey(random io.Reader) (*OnionKey, error) {
+	public, private, err := ed25519.GenerateKey(random)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tor stores the expanded form of the secret key, which is the clamped
+	// SHA-512 digest of the seed.
+	secret := sha512.Sum512(private.Seed())
+	secret[0] &= 248
+	secret[31] &= 127
+	secret[31] |= 64
+
+	return &OnionKey{
+		Secret: secret[:],
+		Public: []byte(public),
+	}, nil
+}
+
+// WriteOnionKey writes the keypair into the given directory using the same
+// layout as Tor's hidden_service directory.
+func WriteOnionKey(dir string, key *OnionKey) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	files := map[string][]byte{
+		SecretKeyFile: key.SecretKeyFile(),
+		PublicKeyFile: key.PublicKeyFile(),
+		HostnameFile:  []byte(key.Hostname() + "\n"),
+	}
+
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validPrefix returns whether it's possible for an onion address to start
+// with the given prefix.
+func validPrefix(prefix string) bool {
+	// The first 51 characters of the address only depend on the public key.
+	if len(prefix) > 51 {
+		return false
+	}
+	for _, ch := range prefix {
+		if !strings.ContainsRune(onionAlphabet, ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchOnionKey generates keys on the given number of workers until it finds
+// one with an onion address starting with the given prefix. The progress
+// function is called periodically with the number of keys tried so far.
+func SearchOnionKey(prefix string, workers int, progress func(attempts uint64)) (*OnionKey, error) {
+	if !validPrefix(prefix) {
+		return nil, fmt.Errorf("prefix '%s' can never appear in an onion address (must be at most 51 characters of [a-z2-7])", prefix)
+	}
+
+	var (
+		attempts uint64
+		found    = make(chan *OnionKey, workers)
+		failed   = make(chan error, workers)
+		stop     = make(chan struct{})
+		wg       sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				key, err := GenerateOnionKey(rand.Reader)
+				if err != nil {
+					failed <- err
+					return
+				}
+				atomic.AddUint64(&attempts, 1)
+
+				// Only the public key determines the prefix, so we don't need
+				// to compute the checksum for every key.
+				if strings.HasPrefix(onionEncoding.EncodeToString(key.Public), prefix) {
+					found <- key
+					return
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(stop)
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case key := <-found:
+			return key, nil
+		case err := <-failed:
+			return nil, err
+		case <-ticker.C:
+			if progress != nil {
+				progress(atomic.LoadUint64(&attempts))
+			}
+		}
+	}
+}
+
+func cmdKeygen(args []string) error {
+	var (
+		oPrefix  string
+		oWorkers int
+	)
+
+	flags := newFlagSet("keygen", "[-prefix prefix] [-j workers] <dir>")
+	flags.StringVar(&oPrefix, "prefix", "", "only accept onion addresses starting with the given prefix")
+	flags.IntVar(&oWorkers, "j", runtime.NumCPU(), "number of workers to search for a prefix with")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("must specify a directory to write the key to")
+	}
+	dir := flags.Arg(0)
+
+	// Don't clobber existing keys.
+	if _, err := os.Stat(filepath.Join(dir, SecretKeyFile)); err == nil {
+		return fmt.Errorf("%s already contains a %s", dir, SecretKeyFile)
+	}
+
+	if oWorkers < 1 {
+		return fmt.Errorf("must have at least one worker")
+	}
+
+	oPrefix = strings.ToLower(oPrefix)
+	expected := math.Pow(32, float64(len(oPrefix)))
+	if oPrefix != "" {
+		log.WithFields(log.Fields{
+			"prefix":   oPrefix,
+			"workers":  oWorkers,
+			"expected": fmt.Sprintf("%.3g", expected),
+		}).Info("searching for onion address with prefix")
+	}
+
+	start := time.Now()
+	key, err := SearchOnionKey(oPrefix, oWorkers, func(attempts uint64) {
+		elapsed := time.Since(start)
+		rate := float64(attempts) / elapsed.Seconds()
+
+		// The number of attempts is geometrically distributed, so the
+		// expected time remaining doesn't depend on how long we've spent.
+		// Long prefixes can take longer than a time.Duration can hold
+		// (about 292 years), so cap the ETA rather than overflowing.
+		var eta interface{} = "more than 292 years"
+		if secs := expected / rate; secs < float64(math.MaxInt64/time.Second) {
+			eta = time.Duration(secs * float64(time.Second)).Round(time.Second)
+		}
+		log.WithFields(log.Fields{
+			"attempts": attempts,
+			"rate":     fmt.Sprintf("%.0f/s", rate),
+			"eta":      eta,
+		}).Info("still searching for onion address")
+	})
+	if err != nil {
+		return fmt.Errorf("generating key: %s", err)
+	}
+
+	if err := WriteOnionKey(dir, key); err != nil {
+		return fmt.Errorf("writing key: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"dir":     dir,
+		"elapsed": time.Since(start).Round(time.Millisecond),
+	}).Infof("generated onion key, use it with -k %s", filepath.Join(dir, SecretKeyFile))
+	fmt.Println(key.Hostname())
+	return nil
+}
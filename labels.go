@@ -0,0 +1,301 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// All of the state of an onion service is stored as labels on the resources
+// mkonion creates, so that the full picture can be recovered from the Docker
+// daemon without any local state. Labels are namespaced using reverse DNS
+// notation, as recommended by Docker.
+const (
+	labelPrefix = "com.cyphar.mkonion."
+
+	// Identifier shared by the network and Tor container of a service.
+	LabelIdent = labelPrefix + "ident"
+	// ID and name of the target container.
+	LabelTarget     = labelPrefix + "target"
+	LabelTargetName = labelPrefix + "target.name"
+	// Port mappings, of the form "onion:container[,onion:container]...".
+	LabelPorts = labelPrefix + "ports"
+	// The onion address of the service. This is only set if the address is
+	// known before the Tor container is created.
+	LabelOnion = labelPrefix + "onion"
+	// Port mappings and onion address of each service in a Tor container
+	// running several onion services, of the form service.<name>.ports and
+	// service.<name>.onion.
+	labelServicePrefix = labelPrefix + "service."
+	// Name of the shared Tor container serving the service, if it doesn't
+	// have its own Tor container.
+	LabelDaemon = labelPrefix + "daemon"
+	// Set to "true" if the service was created with ADD_ONION, and thus only
+	// exists as long as the Tor process does.
+	LabelEphemeral = labelPrefix + "ephemeral"
+	// Set to "true" if the target's traffic is routed through Tor, along with
+	// the (comma-separated) networks the target was disconnected from and
+	// the (comma-separated) aliases it had on each of them, of the form
+	// isolate.aliases.<network>.
+	LabelIsolate              = labelPrefix + "isolate"
+	LabelIsolateNetworks      = labelPrefix + "isolate.networks"
+	labelIsolateAliasesPrefix = labelPrefix + "isolate.aliases."
+	// Name of the existing network the service was created on, if mkonion
+	// didn't create an onion network for it. mkonion never removes it.
+	LabelNetwork = labelPrefix + "network"
+	// Name of the OnionCat container tunnelling UDP ports, and the UDP port
+	// mappings it forwards (of the same form as LabelPorts).
+	LabelOnionCat = labelPrefix + "onioncat"
+	LabelUDPPorts = labelPrefix + "udp.ports"
+	// Named volume holding the hidden_service directory, if any.
+	LabelVolume = labelPrefix + "volume"
+	// Hash of the declarative spec the service was created from. This is only
+	// set for services managed by `mkonion apply`.
+	LabelSpec = labelPrefix + "spec"
+	// Set to "true" on Tor images whose entrypoint resolves target aliases in
+	// the torrc, so that the torrc can forward to an alias rather than an IP.
+	LabelResolve = labelPrefix + "resolve"
+	// Version of mkonion that created the service.
+	LabelVersion = labelPrefix + "version"
+	// Creation time of the service, in RFC 3339 format.
+	LabelCreated = labelPrefix + "created"
+)
+
+// ServiceLabels is the structured form of the labels attached to every
+// resource mkonion creates for an onion service.
+type ServiceLabels struct {
+	Ident        string                         `json:"ident"`
+	Target       string                         `json:"target"`
+	TargetName   string                         `json:"target_name"`
+	Ports        map[string]string              `json:"ports"`
+	Onion        string                         `json:"onion,omitempty"`
+	Services     map[string]*NamedServiceLabels `json:"services,omitempty"`
+	Daemon       string                         `json:"daemon,omitempty"`
+	Ephemeral    bool                           `json:"ephemeral,omitempty"`
+	Isolate      bool                           `json:"isolate,omitempty"`
+	IsolatedFrom []string                       `json:"isolated_from,omitempty"`
+	// IsolatedAliases maps the networks in IsolatedFrom to the aliases the
+	// target had on them.
+	IsolatedAliases map[string][]string `json:"isolated_aliases,omitempty"`
+	Network         string              `json:"network,omitempty"`
+	OnionCat        string              `json:"onioncat,omitempty"`
+	UDPPorts        map[string]string   `json:"udp_ports,omitempty"`
+	Volume          string              `json:"volume,omitempty"`
+	Spec            string              `json:"spec,omitempty"`
+	Version         string              `json:"version"`
+	Created         time.Time           `json:"created"`
+}
+
+// NamedServiceLabels describes one of several onion services run by the same
+// Tor container.
+type NamedServiceLabels struct {
+	Ports map[string]string `json:"ports"`
+	Onion string            `json:"onion,omitempty"`
+}
+
+// TargetRef returns the reference used to find the target container. We prefer
+// the name, so that a recreated target (which has a new ID) is still found.
+func (sl *ServiceLabels) TargetRef() string {
+	if sl.TargetName != "" {
+		return sl.TargetName
+	}
+	return sl.Target
+}
+
+// NetworkName returns the name of the network the target and Tor container
+// share, which is the onion network unless an existing network was reused.
+func (sl *ServiceLabels) NetworkName() string {
+	if sl.Network != "" {
+		return sl.Network
+	}
+	return sl.Ident
+}
+
+// TargetAlias returns the name the Tor container can use to resolve the target.
+// Docker resolves container names on every user-defined network, so targets on
+// a reused network don't get an alias of their own.
+func (sl *ServiceLabels) TargetAlias() string {
+	if sl.Network != "" {
+		return sl.TargetName
+	}
+	return targetAlias(sl.Ident)
+}
+
+func formatPorts(ports map[string]string) string {
+	var onions []string
+	for onion := range ports {
+		onions = append(onions, onion)
+	}
+	sort.Strings(onions)
+
+	var pairs []string
+	for _, onion := range onions {
+		pairs = append(pairs, onion+":"+ports[onion])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func parsePorts(value string) (map[string]string, error) {
+	ports := map[string]string{}
+	if value == "" {
+		return ports, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid port mapping label '%s'", pair)
+		}
+		ports[parts[0]] = parts[1]
+	}
+	return ports, nil
+}
+
+// Labels returns the set of Docker labels describing the service.
+func (sl *ServiceLabels) Labels() map[string]string {
+	labels := map[string]string{
+		LabelIdent:      sl.Ident,
+		LabelTarget:     sl.Target,
+		LabelTargetName: sl.TargetName,
+		LabelPorts:      formatPorts(sl.Ports),
+		LabelVersion:    sl.Version,
+		LabelCreated:    sl.Created.UTC().Format(time.RFC3339),
+	}
+
+	if sl.Onion != "" {
+		labels[LabelOnion] = sl.Onion
+	}
+	if sl.Daemon != "" {
+		labels[LabelDaemon] = sl.Daemon
+	}
+	if sl.Ephemeral {
+		labels[LabelEphemeral] = "true"
+	}
+	if sl.Isolate {
+		labels[LabelIsolate] = "true"
+		labels[LabelIsolateNetworks] = strings.Join(sl.IsolatedFrom, ",")
+		for network, aliases := range sl.IsolatedAliases {
+			labels[labelIsolateAliasesPrefix+network] = strings.Join(aliases, ",")
+		}
+	}
+	if sl.Network != "" {
+		labels[LabelNetwork] = sl.Network
+	}
+	if sl.OnionCat != "" {
+		labels[LabelOnionCat] = sl.OnionCat
+		labels[LabelUDPPorts] = formatPorts(sl.UDPPorts)
+	}
+	if sl.Volume != "" {
+		labels[LabelVolume] = sl.Volume
+	}
+	if sl.Spec != "" {
+		labels[LabelSpec] = sl.Spec
+	}
+	for name, svc := range sl.Services {
+		labels[labelServicePrefix+name+".ports"] = formatPorts(svc.Ports)
+		if svc.Onion != "" {
+			labels[labelServicePrefix+name+".onion"] = svc.Onion
+		}
+	}
+	return labels
+}
+
+// ParseServiceLabels recovers the structured service labels from a set of
+// Docker labels. Unrelated labels are ignored, and an error is returned if the
+// labels don't describe an mkonion service.
+func ParseServiceLabels(labels map[string]string) (*ServiceLabels, error) {
+	ident, ok := labels[LabelIdent]
+	if !ok {
+		return nil, fmt.Errorf("missing %s label", LabelIdent)
+	}
+
+	ports, err := parsePorts(labels[LabelPorts])
+	if err != nil {
+		return nil, err
+	}
+
+	sl := &ServiceLabels{
+		Ident:      ident,
+		Target:     labels[LabelTarget],
+		TargetName: labels[LabelTargetName],
+		Ports:      ports,
+		Onion:      labels[LabelOnion],
+		Daemon:     labels[LabelDaemon],
+		Ephemeral:  labels[LabelEphemeral] == "true",
+		Isolate:    labels[LabelIsolate] == "true",
+		Network:    labels[LabelNetwork],
+		OnionCat:   labels[LabelOnionCat],
+		Volume:     labels[LabelVolume],
+		Spec:       labels[LabelSpec],
+		Version:    labels[LabelVersion],
+	}
+
+	if networks := labels[LabelIsolateNetworks]; sl.Isolate && networks != "" {
+		sl.IsolatedFrom = strings.Split(networks, ",")
+	}
+	for label, value := range labels {
+		if !sl.Isolate || !strings.HasPrefix(label, labelIsolateAliasesPrefix) || value == "" {
+			continue
+		}
+		if sl.IsolatedAliases == nil {
+			sl.IsolatedAliases = map[string][]string{}
+		}
+		sl.IsolatedAliases[strings.TrimPrefix(label, labelIsolateAliasesPrefix)] = strings.Split(value, ",")
+	}
+
+	if sl.OnionCat != "" {
+		sl.UDPPorts, err = parsePorts(labels[LabelUDPPorts])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for label, value := range labels {
+		if !strings.HasPrefix(label, labelServicePrefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(label, labelServicePrefix)
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			continue
+		}
+		name, field := name[:i], name[i+1:]
+
+		if sl.Services == nil {
+			sl.Services = map[string]*NamedServiceLabels{}
+		}
+		svc, ok := sl.Services[name]
+		if !ok {
+			svc = &NamedServiceLabels{Ports: map[string]string{}}
+			sl.Services[name] = svc
+		}
+
+		switch field {
+		case "ports":
+			svc.Ports, err = parsePorts(value)
+			if err != nil {
+				return nil, err
+			}
+		case "onion":
+			svc.Onion = value
+		}
+	}
+
+	if created, ok := labels[LabelCreated]; ok {
+		sl.Created, err = time.Parse(time.RFC3339, created)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label: %s", LabelCreated, err)
+		}
+	}
+
+	return sl, nil
+}
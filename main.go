@@ -10,179 +10,173 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"strconv"
+	"os"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/client"
 )
 
-func IsInteger(s string) bool {
-	_, err := strconv.Atoi(s)
-	return err == nil
-}
+// Version is the version of mkonion, which is recorded on every resource
+// created by mkonion.
+const Version = "0.1.0-dev"
 
-func mkonion() (err error) {
+func mkonion() error {
 	var (
 		oMappings   *flagList = new(flagList)
 		oPrivateKey string
+		oPersist    bool
+		oShared     bool
+		oEphemeral  bool
+		oIsolate    bool
+		oOnionCat   bool
+		oTimeout    time.Duration
+		oOutput     string
+		oDryRun     bool
+		oRenderTo   string
+		oNetName    string
+		oName       string
+		oServices   *serviceList    = new(serviceList)
+		oImage      *ImageOptions   = new(ImageOptions)
+		oNetwork    *NetworkOptions = new(NetworkOptions)
 	)
 
-	flag.Var(oMappings, "p", "specify a list of port mappings of the form '[onion:]container'")
-	flag.StringVar(&oPrivateKey, "k", "", "specify a private_key to use for the hidden service")
+	flag.Var(oMappings, "p", "specify a list of port mappings of the form '[onion:]container[/udp]'")
+	flag.StringVar(&oName, "name", "", "name of the onion service (prefixed with "+identifierPrefix+"), rather than a random one")
+	flag.StringVar(&oPrivateKey, "k", "", "specify a hs_ed25519_secret_key (or a directory containing one) to use for the hidden service")
+	flag.Var(oServices, "service", "add a named onion service of the form 'name=NAME,port=[onion:]container[,port=...][,key=PATH]' (can be repeated)")
+	flag.BoolVar(&oPersist, "persist", false, "store the hidden_service directory in a named volume, reused for the same target")
+	flag.BoolVar(&oShared, "shared", false, "serve the onion service from a shared tor daemon rather than a new tor container")
+	flag.BoolVar(&oEphemeral, "ephemeral", false, "create the onion service using the tor control port, so it is lost if tor restarts")
+	flag.BoolVar(&oIsolate, "isolate", false, "route all of the traffic of the container through tor, and disconnect it from every other network")
+	flag.BoolVar(&oOnionCat, "onioncat", false, "forward the UDP ports of the container over the onion service with an onioncat container")
+	flag.DurationVar(&oTimeout, "publish-timeout", DefaultPublishTimeout, "how long to wait for the onion service to be published (0 to not wait)")
+	flag.StringVar(&oOutput, "output", "", "write the result to stdout in the given format ("+strings.Join(OutputFormats, ", ")+")")
+	flag.BoolVar(&oDryRun, "dry-run", false, "print what would be done to create the onion service, without changing anything")
+	flag.StringVar(&oRenderTo, "render-to", "", "write the build context of the Tor image to the given directory rather than creating an onion service")
+	oImage.AddFlags(flag.CommandLine)
+	oNetwork.AddFlags(flag.CommandLine)
+	flag.StringVar(&oNetName, "network", "", "join an existing user-defined network the container is connected to, rather than creating an onion network")
 
 	flag.Parse()
 	oTargetContainer := flag.Arg(0)
 
+	// Rendering the build context doesn't need the daemon (or a target).
+	if oRenderTo != "" {
+		if err := oImage.Validate(); err != nil {
+			return err
+		}
+		tag, err := RenderBuildContext(oImage, oRenderTo)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"dir": oRenderTo,
+			"tag": tag,
+		}).Infof("wrote build context, build it with `docker build -t %s %s`", tag, oRenderTo)
+		if !oDryRun {
+			return nil
+		}
+	}
+
 	if flag.NArg() != 1 || oTargetContainer == "" {
 		flag.Usage()
 		return fmt.Errorf("must specify a container to create an onion service for")
 	}
 
 	// Load the private key.
-	var privatekey []byte
+	var key *OnionKey
 	if oPrivateKey != "" {
-		pk, err := ioutil.ReadFile(oPrivateKey)
+		var err error
+		key, err = LoadOnionKey(oPrivateKey)
 		if err != nil {
-			return fmt.Errorf("reading private key: %s", err)
+			return err
 		}
-
-		// -k is technically unsafe if you don't know what it does
-		log.WithFields(log.Fields{
-			"keypath": oPrivateKey,
-		}).Warn("using the -k option results in your private key being embedded in the resulting image: do not share the image or any images derived from it with anybody")
-
-		privatekey = pk
 	}
 
 	// Check the validity of arguments here.
-	for _, arg := range *oMappings {
-		ports := strings.SplitN(arg, ":", 2)
-		if len(ports) == 0 || len(ports) > 2 {
-			return fmt.Errorf("port mappings must be of the form '[onion:]container'")
-		}
-
-		for _, port := range ports {
-			if !IsInteger(port) {
-				return fmt.Errorf("port mappings must be integers")
-			}
-		}
+	if err := oImage.Validate(); err != nil {
+		return err
 	}
-
-	cli, err := client.NewEnvClient()
-	if err != nil {
-		return fmt.Errorf("connecting to client: %s", err)
+	if err := ValidateMappings(*oMappings); err != nil {
+		return err
 	}
-
-	ident := generateIdentifier()
-	networkID, err := CreateOnionNetwork(cli, ident)
-	if err != nil {
-		return fmt.Errorf("creating onion network: %s", err)
+	if len(*oServices) > 0 && (len(*oMappings) > 0 || key != nil) {
+		return fmt.Errorf("cannot use -p or -k with -service, specify the ports and key of each service instead")
 	}
-	log.WithFields(log.Fields{
-		"network": ident,
-	}).Info("created onion network")
-	defer func() {
-		if err != nil {
-			if err := PurgeOnionNetwork(cli, networkID); err != nil {
-				log.Warnf("purge onion network: %s", err)
-			}
-		}
-	}()
-
-	if err := ConnectOnionNetwork(cli, oTargetContainer, networkID); err != nil {
-		return fmt.Errorf("connecting target to onion network: %s", err)
+	if err := ValidateServices(*oServices); err != nil {
+		return err
 	}
-	log.WithFields(log.Fields{
-		"network":   ident,
-		"container": oTargetContainer,
-	}).Info("attached container to onion network")
-
-	ip, err := FindOnionIPAddress(cli, oTargetContainer, networkID)
-	if err != nil {
-		return fmt.Errorf("finding target onion ip: %s", err)
+	if err := ValidateOutputFormat(oOutput); err != nil {
+		return err
 	}
-	log.WithFields(log.Fields{
-		"network":   ident,
-		"container": oTargetContainer,
-		"ip":        ip,
-	}).Info("found target address")
-
-	ports, err := FindTargetPorts(cli, oTargetContainer)
-	if err != nil {
-		return fmt.Errorf("finding target ports: %s", err)
+	if oDryRun && oOutput == "env" {
+		return fmt.Errorf("cannot use -output env with -dry-run, use json or yaml")
 	}
-
-	// Add all exposed ports naively to mappings before parsing arguments.
-	portMappings := map[string]string{}
-	for _, port := range ports {
-		log.Infof("forwarding port: %s", port)
-		if port.Proto() != "tcp" {
-			log.Warn("encountered non-TCP exposed port in container: %s", port)
-		}
-		portMappings[port.Port()] = port.Port()
+	if err := oNetwork.Validate(); err != nil {
+		return err
 	}
-
-	// Now deal with arguments.
-	for _, arg := range *oMappings {
-		var onion, container string
-
-		ports := strings.SplitN(arg, ":", 2)
-		onion = ports[0]
-
-		// The format is [onion:]container.
-		switch len(ports) {
-		case 2:
-			container = ports[1]
-		case 1:
-			container = ports[0]
-		default:
-			return fmt.Errorf("port mappings must be of the form '[onion:]container'")
-		}
-
-		// Can't redefine external mappings.
-		if _, ok := portMappings[onion]; ok {
-			return fmt.Errorf("cannot have multiple definitons of onion port mappings")
+	if oName != "" {
+		if _, err := NameIdentifier(oName); err != nil {
+			return err
 		}
-
-		portMappings[onion] = container
 	}
 
-	torrc, err := GenerateConfig(cli, GenerateTargetMappings(ip, portMappings))
+	cli, err := client.NewEnvClient()
 	if err != nil {
-		return fmt.Errorf("generating torrc: %s", err)
+		return fmt.Errorf("connecting to client: %s", err)
 	}
-	log.Info("generated torrc config")
 
-	buildOptions := &FakeBuildOptions{
-		ident:      ident,
-		networkID:  networkID,
-		torrc:      torrc,
-		privatekey: privatekey,
+	options := &CreateOptions{
+		Target:         oTargetContainer,
+		Name:           oName,
+		Mappings:       *oMappings,
+		Key:            key,
+		Services:       *oServices,
+		Persist:        oPersist,
+		Shared:         oShared,
+		Ephemeral:      oEphemeral,
+		Isolate:        oIsolate,
+		OnionCat:       oOnionCat,
+		PublishTimeout: oTimeout,
+		Image:          oImage,
+		Network:        oNetwork,
+		NetworkName:    oNetName,
 	}
 
-	containerID, err := FakeBuildRun(cli, buildOptions)
-	if err != nil {
-		return fmt.Errorf("starting tor daemon: %s", err)
+	if oDryRun {
+		dryRun, err := DryRunOnionService(cli, options)
+		if err != nil {
+			return err
+		}
+		return WriteDryRun(os.Stdout, oOutput, dryRun)
 	}
-	log.WithFields(log.Fields{
-		"container": containerID,
-	}).Infof("tor daemon started")
 
-	// XXX: This has issues because we need to wait for Tor to make a hostname.
-	onionAddr, err := GetOnionHostname(cli, containerID)
+	result, err := CreateOnionService(cli, options)
 	if err != nil {
-		return fmt.Errorf("get onion hostname: %s", err)
+		return err
+	}
+
+	if oOutput != "" {
+		return WriteResult(os.Stdout, oOutput, result)
 	}
-	log.WithFields(log.Fields{
-		"onion": onionAddr,
-	}).Infof("retrieved Tor onion address")
 	return nil
 }
 
 func main() {
-	if err := mkonion(); err != nil {
+	// If the first argument is a known subcommand, run it. Otherwise we fall
+	// back to creating a new onion service.
+	run := func([]string) error { return mkonion() }
+	var args []string
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			run = cmd
+			args = os.Args[2:]
+		}
+	}
+
+	if err := run(args); err != nil {
 		log.Fatal(err)
 	}
 }
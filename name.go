@@ -8,31 +8,132 @@
 package main
 
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"github.com/docker/engine-api/client"
 )
 
 const (
 	identifierPrefix = "mkonion_"
 	identifierLength = 16
+
+	// maxIdentifierAttempts is how many random identifiers we try before
+	// giving up. With 62^16 possible identifiers, needing more than one
+	// means something is very wrong.
+	maxIdentifierAttempts = 5
 )
 
-func init() {
-	// We need to seed the randomness.
-	now := time.Now()
-	rand.Seed(now.Unix() * int64(now.Nanosecond()))
+// nameRegexp matches the names users can give to onion services. Names end up
+// as the names of networks and containers, so they follow Docker's rules.
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// generateIdentifier returns a new random identifier. The randomness comes
+// from crypto/rand, so identifiers don't collide just because several copies
+// of mkonion started at the same time.
+func generateIdentifier() (string, error) {
+	const identLetters = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	numLetters := big.NewInt(int64(len(identLetters)))
+
+	ident := make([]byte, identifierLength)
+	for i := range ident {
+		n, err := rand.Int(rand.Reader, numLetters)
+		if err != nil {
+			return "", err
+		}
+		ident[i] = identLetters[n.Int64()]
+	}
+
+	return identifierPrefix + string(ident), nil
+}
+
+// NameIdentifier returns the identifier of an onion service with a
+// user-provided name. The name is prefixed (unless it already is) so that the
+// service can still be found, and the same name always gives the same
+// identifier.
+func NameIdentifier(name string) (string, error) {
+	ident := strings.TrimPrefix(name, identifierPrefix)
+	if !nameRegexp.MatchString(ident) {
+		return "", fmt.Errorf("invalid name '%s': must match %s", name, nameRegexp)
+	}
+	// Don't let names clash with the shared Tor daemon or key volumes.
+	if identifierPrefix+ident == SharedDaemonName || strings.HasPrefix(ident, "hs_") {
+		return "", fmt.Errorf("invalid name '%s': reserved by mkonion", name)
+	}
+	return identifierPrefix + ident, nil
+}
+
+// identifierInUse returns what (if anything) is already using an identifier.
+// Everything mkonion creates for an onion service is named after its
+// identifier, so it has to be free as a network, container and volume name.
+func identifierInUse(cli *client.Client, ident string) (string, error) {
+	if _, err := cli.NetworkInspect(ident); err == nil {
+		return "network", nil
+	} else if !client.IsErrNetworkNotFound(err) {
+		return "", err
+	}
+
+	for _, name := range []string{ident, onionCatName(ident)} {
+		if _, err := cli.ContainerInspect(name); err == nil {
+			return "container", nil
+		} else if !client.IsErrContainerNotFound(err) {
+			return "", err
+		}
+	}
+
+	if _, err := cli.VolumeInspect(ident); err == nil {
+		return "volume", nil
+	} else if !client.IsErrVolumeNotFound(err) {
+		return "", err
+	}
+
+	return "", nil
 }
 
-func generateIdentifier() string {
-	const (
-		identLetters = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-		numLetters   = len(identLetters)
-	)
+// NewIdentifier returns a free identifier for a new onion service. If name is
+// set the identifier is derived from it, and it is an error for it to be in
+// use. Otherwise, random identifiers are tried until a free one is found.
+func NewIdentifier(cli *client.Client, name string) (string, error) {
+	if name != "" {
+		ident, err := NameIdentifier(name)
+		if err != nil {
+			return "", err
+		}
+		if used, err := identifierInUse(cli, ident); err != nil {
+			return "", err
+		} else if used != "" {
+			return "", fmt.Errorf("name %s is already used by a %s", ident, used)
+		}
+		return ident, nil
+	}
 
-	var ident string
-	for i := 0; i < identifierLength; i++ {
-		ident += string(identLetters[rand.Intn(numLetters)])
+	for i := 0; i < maxIdentifierAttempts; i++ {
+		ident, err := generateIdentifier()
+		if err != nil {
+			return "", fmt.Errorf("generating identifier: %s", err)
+		}
+		if used, err := identifierInUse(cli, ident); err != nil {
+			return "", err
+		} else if used == "" {
+			return ident, nil
+		}
 	}
+	return "", fmt.Errorf("no free identifier after %d attempts", maxIdentifierAttempts)
+}
+
+// isErrAlreadyExists returns whether the daemon refused to create something
+// because something with the same name already exists.
+func isErrAlreadyExists(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "already exists") || strings.Contains(err.Error(), "already in use"))
+}
 
-	return identifierPrefix + ident
+// persistentVolumeName returns the name of the named volume used to store the
+// hidden_service directory for the given target container. It only depends on
+// the name of the target, so recreating the target (or the onion service) will
+// reuse the same volume.
+func persistentVolumeName(targetName string) string {
+	return identifierPrefix + "hs_" + strings.TrimPrefix(targetName, "/")
 }
@@ -8,7 +8,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
+	"sort"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/client"
@@ -17,18 +21,277 @@ import (
 	"github.com/docker/go-connections/nat"
 )
 
-// CreateOnionNetwork creates a new bridge network with a random (but recognisable)
-// name. If it can't create a name after XXX attempts, it will return an error.
-func CreateOnionNetwork(cli *client.Client, ident string) (string, error) {
-	options := types.NetworkCreate{
+// By default the onion network is a bridge network, and Docker picks its
+// subnet. Docker only has a few default address pools, and every onion service
+// has its own network, so users can pick the subnet (or ask mkonion to find a
+// free one), driver and other settings of the network themselves.
+
+const (
+	// DefaultNetworkDriver is the driver used for onion networks.
+	DefaultNetworkDriver = "bridge"
+
+	// autoSubnet asks for a free /24 from autoSubnetPool. The pool doesn't
+	// overlap the VirtualAddrNetworkIPv4 of isolated targets.
+	autoSubnet     = "auto"
+	autoSubnetPool = "10.128.0.0/10"
+
+	// enableIPv6Option is the driver option Docker uses to enable IPv6.
+	// XXX: The version of engine-api we vendor doesn't have EnableIPv6, so
+	//      this needs a daemon which understands the option (Docker 27.1+).
+	//      Older daemons ignore it, so we check that the network actually
+	//      got an IPv6 subnet.
+	enableIPv6Option = "com.docker.network.enable_ipv6"
+)
+
+// NetworkOptions describes the onion network of a service.
+type NetworkOptions struct {
+	// Driver is the network driver, DefaultNetworkDriver if empty.
+	Driver string
+	// Subnets are the subnets of the network, in CIDR notation. A subnet of
+	// "auto" is replaced with a free /24. If there are none, Docker picks.
+	Subnets []string
+	// Gateways are the gateways of the network, each of which has to be in
+	// one of the subnets.
+	Gateways []string
+	// Internal networks have no route to the outside world.
+	Internal bool
+	// IPv6 enables IPv6 on the network.
+	IPv6 bool
+	// DriverOptions are passed to the network driver.
+	DriverOptions map[string]string
+}
+
+// AddFlags adds the flags for configuring the onion network.
+func (options *NetworkOptions) AddFlags(flags *flag.FlagSet) {
+	options.DriverOptions = map[string]string{}
+	flags.StringVar(&options.Driver, "network-driver", DefaultNetworkDriver, "driver of the onion network (bridge, macvlan, ...)")
+	flags.Var((*flagList)(&options.Subnets), "subnet", "subnet of the onion network in CIDR notation, or 'auto' to pick a free range from "+autoSubnetPool+" (can be repeated)")
+	flags.Var((*flagList)(&options.Gateways), "gateway", "gateway of the onion network, which must be in one of the subnets (can be repeated)")
+	flags.BoolVar(&options.Internal, "internal", false, "make the onion network internal, so it has no route to the outside world")
+	flags.BoolVar(&options.IPv6, "ipv6", false, "enable IPv6 on the onion network")
+	flags.Var((*optionMap)(&options.DriverOptions), "network-opt", "driver option of the onion network of the form 'key=value' (can be repeated)")
+}
+
+// Validate makes sure that the options are well-formed. Overlapping subnets
+// can only be detected once we talk to the daemon.
+func (options *NetworkOptions) Validate() error {
+	// XXX: Overlay networks have to be attachable for standalone containers
+	//      to join them, which the engine-api we vendor can't ask for.
+	if options.Driver == "overlay" {
+		return fmt.Errorf("cannot use the overlay driver, as the onion network would not be attachable")
+	}
+
+	var subnets []*net.IPNet
+	ipv6 := false
+	for _, subnet := range options.Subnets {
+		if subnet == autoSubnet {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("invalid subnet '%s': %s", subnet, err)
+		}
+		for _, other := range subnets {
+			if subnetsOverlap(ipnet, other) {
+				return fmt.Errorf("subnets %s and %s overlap", ipnet, other)
+			}
+		}
+		subnets = append(subnets, ipnet)
+		ipv6 = ipv6 || ipnet.IP.To4() == nil
+	}
+	if ipv6 && !options.IPv6 {
+		return fmt.Errorf("cannot use an IPv6 subnet without enabling IPv6")
+	}
+
+	for _, gateway := range options.Gateways {
+		ip := net.ParseIP(gateway)
+		if ip == nil {
+			return fmt.Errorf("invalid gateway '%s'", gateway)
+		}
+		if findSubnet(subnets, ip) == nil {
+			return fmt.Errorf("gateway %s is not in any of the subnets", gateway)
+		}
+	}
+
+	for key := range options.DriverOptions {
+		if strings.HasPrefix(key, labelPrefix) || key == enableIPv6Option {
+			return fmt.Errorf("cannot set network option %s", key)
+		}
+	}
+	return nil
+}
+
+// IsDefault returns whether the options don't change anything about the onion
+// network.
+func (options *NetworkOptions) IsDefault() bool {
+	return (options.Driver == "" || options.Driver == DefaultNetworkDriver) &&
+		len(options.Subnets) == 0 && len(options.Gateways) == 0 &&
+		!options.Internal && !options.IPv6 && len(options.DriverOptions) == 0
+}
+
+// subnetsOverlap returns whether two subnets share any addresses.
+func subnetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// findSubnet returns the subnet containing ip, if any.
+func findSubnet(subnets []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// usedSubnet is a subnet of an existing Docker network.
+type usedSubnet struct {
+	network string
+	subnet  *net.IPNet
+}
+
+// usedSubnets returns the subnets of every existing Docker network.
+func usedSubnets(cli *client.Client) ([]usedSubnet, error) {
+	networks, err := cli.NetworkList(types.NetworkListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var used []usedSubnet
+	for _, network := range networks {
+		for _, config := range network.IPAM.Config {
+			if _, ipnet, err := net.ParseCIDR(config.Subnet); err == nil {
+				used = append(used, usedSubnet{network.Name, ipnet})
+			}
+		}
+	}
+	return used, nil
+}
+
+// freeSubnet returns the first /24 in autoSubnetPool which doesn't overlap any
+// of the given subnets.
+func freeSubnet(used []*net.IPNet) (*net.IPNet, error) {
+	_, pool, err := net.ParseCIDR(autoSubnetPool)
+	if err != nil {
+		return nil, err
+	}
+
+	base := pool.IP.To4()
+	ones, _ := pool.Mask.Size()
+	for i := 0; i < 1<<uint(24-ones); i++ {
+		candidate := &net.IPNet{
+			IP:   net.IPv4(base[0], base[1]+byte(i>>8), byte(i), 0).To4(),
+			Mask: net.CIDRMask(24, 32),
+		}
+
+		free := true
+		for _, subnet := range used {
+			free = free && !subnetsOverlap(candidate, subnet)
+		}
+		if free {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("no free subnet left in %s", autoSubnetPool)
+}
+
+// networkCreateConfig works out the request used to create an onion network,
+// picking free subnets and making sure the subnets don't overlap any existing
+// network. It only reads from the daemon.
+func networkCreateConfig(cli *client.Client, ident string, options *NetworkOptions, internal bool, labels map[string]string) (types.NetworkCreate, error) {
+	if options == nil {
+		options = &NetworkOptions{}
+	}
+
+	driver := options.Driver
+	if driver == "" {
+		driver = DefaultNetworkDriver
+	}
+
+	// XXX: The version of engine-api we vendor doesn't support network labels,
+	//      so we store them as driver options instead. The bridge driver
+	//      ignores options it doesn't know about, and they still show up in
+	//      `docker network inspect`. Other drivers might reject them, so their
+	//      networks go without, and the labels of the Tor container are used.
+	driverOptions := map[string]string{}
+	for key, value := range options.DriverOptions {
+		driverOptions[key] = value
+	}
+	if driver == DefaultNetworkDriver {
+		for key, value := range labels {
+			driverOptions[key] = value
+		}
+	}
+	if options.IPv6 {
+		driverOptions[enableIPv6Option] = "true"
+	}
+
+	config := types.NetworkCreate{
 		Name:           ident,
 		CheckDuplicate: true,
-		Driver:         "bridge",
+		Driver:         driver,
+		Internal:       internal || options.Internal,
+		Options:        driverOptions,
+	}
+	if len(options.Subnets) == 0 {
+		return config, nil
 	}
 
-	resp, err := cli.NetworkCreate(options)
+	used, err := usedSubnets(cli)
+	if err != nil {
+		return config, fmt.Errorf("listing networks: %s", err)
+	}
+	var taken []*net.IPNet
+	for _, u := range used {
+		taken = append(taken, u.subnet)
+		for _, requested := range options.Subnets {
+			if requested == autoSubnet {
+				continue
+			}
+			if _, ipnet, err := net.ParseCIDR(requested); err == nil && subnetsOverlap(ipnet, u.subnet) {
+				return config, fmt.Errorf("subnet %s overlaps subnet %s of network %s", ipnet, u.subnet, u.network)
+			}
+		}
+	}
+
+	var subnets []*net.IPNet
+	for _, requested := range options.Subnets {
+		var ipnet *net.IPNet
+		if requested == autoSubnet {
+			ipnet, err = freeSubnet(append(taken, subnets...))
+		} else {
+			_, ipnet, err = net.ParseCIDR(requested)
+		}
+		if err != nil {
+			return config, err
+		}
+		subnets = append(subnets, ipnet)
+	}
+
+	for _, subnet := range subnets {
+		ipam := networkTypes.IPAMConfig{Subnet: subnet.String()}
+		for _, gateway := range options.Gateways {
+			if ip := net.ParseIP(gateway); findSubnet([]*net.IPNet{subnet}, ip) != nil {
+				ipam.Gateway = gateway
+			}
+		}
+		config.IPAM.Config = append(config.IPAM.Config, ipam)
+	}
+	return config, nil
+}
+
+// CreateOnionNetwork creates a new network named after the identifier of the
+// onion service. If a network with that name already exists, an error for which
+// isErrAlreadyExists is true is returned. The given labels are attached to the
+// network. An internal network has no route to the outside world.
+func CreateOnionNetwork(cli *client.Client, ident string, options *NetworkOptions, internal bool, labels map[string]string) (string, error) {
+	config, err := networkCreateConfig(cli, ident, options, internal, labels)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := cli.NetworkCreate(config)
 	if err != nil {
-		// TODO: Retry if we get "already exists".
 		return "", err
 	}
 
@@ -36,17 +299,88 @@ func CreateOnionNetwork(cli *client.Client, ident string) (string, error) {
 		log.Warn(resp.Warning)
 	}
 
+	if options != nil && options.IPv6 {
+		if err := checkIPv6(cli, ident); err != nil {
+			if err := cli.NetworkRemove(ident); err != nil {
+				log.Warnf("removing network %s: %s", ident, err)
+			}
+			return "", err
+		}
+	}
+
 	return ident, nil
 }
 
+// checkIPv6 makes sure IPv6 is enabled on a network. Docker gives every network
+// with IPv6 enabled an IPv6 subnet.
+func checkIPv6(cli *client.Client, network string) error {
+	inspect, err := cli.NetworkInspect(network)
+	if err != nil {
+		return fmt.Errorf("inspecting network: %s", err)
+	}
+	for _, config := range inspect.IPAM.Config {
+		if ip, _, err := net.ParseCIDR(config.Subnet); err == nil && ip.To4() == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("network %s has no IPv6 subnet, the daemon ignored %s (it needs Docker 27.1 or later)", network, enableIPv6Option)
+}
+
 // ConnectOnionNetwork connects a target container to the onion network, allowing
-// the container to be accessed by the Tor relay container.
-func ConnectOnionNetwork(cli *client.Client, target, network string) error {
-	// XXX: Should configure this to use a subnet like 10.x.x.x.
+// the container to be accessed by the Tor relay container using the given alias
+// (if any).
+func ConnectOnionNetwork(cli *client.Client, target, network, alias string) error {
 	options := &networkTypes.EndpointSettings{}
+	if alias != "" {
+		options.Aliases = []string{alias}
+	}
 	return cli.NetworkConnect(network, target, options)
 }
 
+// With -network, the Tor container joins an existing user-defined network which
+// the target is already connected to, rather than mkonion creating an onion
+// network. The network doesn't belong to mkonion, so it is never removed, and
+// the service is found through the labels of its Tor container instead.
+
+// CheckReusableNetwork makes sure that an existing network can be shared by the
+// target and the Tor container.
+func CheckReusableNetwork(cli *client.Client, name string, target types.ContainerJSON) (types.NetworkResource, error) {
+	network, err := cli.NetworkInspect(name)
+	if err != nil {
+		return network, fmt.Errorf("inspecting network: %s", err)
+	}
+
+	switch {
+	case network.Name == "bridge" || network.Name == "host" || network.Name == "none":
+		return network, fmt.Errorf("cannot use network %s, it must be a user-defined network", network.Name)
+	case strings.HasPrefix(network.Name, identifierPrefix):
+		return network, fmt.Errorf("cannot use network %s, it belongs to another onion service", network.Name)
+	}
+
+	if target.NetworkSettings == nil || target.NetworkSettings.Networks[network.Name] == nil {
+		return network, fmt.Errorf("target is not connected to network %s", network.Name)
+	}
+	return network, nil
+}
+
+// CheckReachable makes sure that a container can reach the target at the given
+// address, by connecting to one of the given ports (or pinging it if none of
+// them are open). It uses the nc and ping commands of the container.
+func CheckReachable(cli *client.Client, containerID, addr string, ports map[string]string) error {
+	var containerPorts []string
+	for _, port := range ports {
+		containerPorts = append(containerPorts, port)
+	}
+	sort.Strings(containerPorts)
+
+	script := fmt.Sprintf(`for port in %s; do nc -z -w 5 %s "$port" 2>/dev/null && exit 0; done; ping -c 1 -W 5 %s >/dev/null 2>&1`,
+		strings.Join(containerPorts, " "), addr, addr)
+	if err := execInContainer(cli, containerID, []string{"/bin/sh", "-c", script}); err != nil {
+		return fmt.Errorf("cannot reach %s: %s", addr, err)
+	}
+	return nil
+}
+
 // PurgeOnionNetwork purges an onion network, disconnecting all containers with
 // it. We assume that nobody is adding containers to this network.
 func PurgeOnionNetwork(cli *client.Client, network string) error {
@@ -0,0 +1,382 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cyphar/mkonion/buildctx"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	containerTypes "github.com/docker/engine-api/types/container"
+	networkTypes "github.com/docker/engine-api/types/network"
+	"github.com/docker/engine-api/types/strslice"
+	"github.com/docker/go-connections/nat"
+)
+
+// Tor only carries TCP, so UDP ports can't be forwarded by an onion service
+// directly. With -onioncat, mkonion runs an OnionCat sidecar next to the Tor
+// container. OnionCat tunnels IPv6 over the onion service (using virtual port
+// OnionCatPort), and every onion address has a matching IPv6 address in
+// fd87:d87e:eb43::/48. The sidecar listens for UDP on that address and relays
+// each UDP port to the target with socat.
+//
+// Clients need to run OnionCat too. The IPv6 address of a v3 onion address
+// can't be turned back into the onion address, so clients have to map it to
+// the onion address (in their hosts file) themselves.
+//
+// XXX: The sidecar is started before Tor has generated the onion address, so
+//      its configuration is copied in afterwards and the sidecar waits for it.
+//      The configuration lives in the writable layer of the sidecar, so it
+//      survives the sidecar being restarted.
+//
+// XXX: The engine API we use can't set sysctls, so the tunnel only works if
+//      IPv6 isn't disabled inside containers (it is by default on some
+//      daemons without IPv6 support).
+
+const (
+	// OnionCatRepository is the repository used for the OnionCat image. Like
+	// the Tor image, the tag is derived from the content of the image.
+	OnionCatRepository = "mkonion/onioncat"
+
+	// OnionCatBaseImage is the image the OnionCat image builds on. OnionCat
+	// isn't packaged for Alpine.
+	OnionCatBaseImage = "debian:bookworm-slim"
+
+	// OnionCatPort is the virtual port of the onion service which OnionCat
+	// peers connect to.
+	OnionCatPort = "8060"
+
+	// OnionCatEntrypointPath is where the entrypoint lives in the OnionCat
+	// image, and OnionCatConfigPath is where mkonion copies its configuration.
+	OnionCatEntrypointPath = "/usr/local/bin/mkonion-onioncat"
+	OnionCatConfigPath     = "/etc/mkonion/onioncat.conf"
+
+	// onionCatTimeout is how long we wait for the OnionCat container to give
+	// the tunnel interface its address. The entrypoint gives up by itself
+	// after 30 seconds, so this is only a backstop.
+	onionCatTimeout = time.Minute
+
+	// OnionCatEntrypoint is the entrypoint of the OnionCat image. It waits for
+	// mkonion to copy in the configuration, starts ocat and then starts a
+	// socat relay for every UDP port.
+	OnionCatEntrypoint = `#!/bin/sh
+# mkonion-onioncat: tunnel the UDP ports of a target over its onion service.
+set -f
+
+CONF=/etc/mkonion/onioncat.conf
+
+while [ ! -f "$CONF" ]; do
+	sleep 1
+done
+. "$CONF"
+
+ocat -B -l "0.0.0.0:$ONIONCAT_PORT" "$ONION" &
+ocat=$!
+trap 'kill "$ocat" 2>/dev/null; exit 0' TERM INT
+
+i=0
+until ip -6 addr show | grep -q " $ADDRESS/"; do
+	i=$((i + 1))
+	if [ "$i" -ge 30 ] || ! kill -0 "$ocat" 2>/dev/null; then
+		echo "mkonion-onioncat: tunnel interface never got address $ADDRESS" >&2
+		exit 1
+	fi
+	sleep 1
+done
+
+for mapping in $UDP_PORTS; do
+	socat -T 60 "UDP6-RECVFROM:${mapping%%:*},bind=[$ADDRESS],fork,reuseaddr" "UDP:$TARGET:${mapping#*:}" &
+done
+
+while kill -0 "$ocat" 2>/dev/null; do
+	sleep 5
+done
+echo "mkonion-onioncat: ocat exited" >&2
+exit 1
+`
+)
+
+// onionCatPrefix is the IPv6 prefix OnionCat uses for onion addresses.
+var onionCatPrefix = []byte{0xfd, 0x87, 0xd8, 0x7e, 0xeb, 0x43}
+
+// onionCatDockerfile returns the Dockerfile of the OnionCat image.
+func onionCatDockerfile() string {
+	return fmt.Sprintf(`
+	FROM %s
+	RUN apt-get update && \
+		apt-get install -y --no-install-recommends onioncat socat iproute2 && \
+		rm -rf /var/lib/apt/lists/* && \
+		mkdir -p %s
+	COPY mkonion-onioncat %s
+	ENTRYPOINT [%q]
+	LABEL %q=%q
+	`, OnionCatBaseImage, path.Dir(OnionCatConfigPath), OnionCatEntrypointPath, OnionCatEntrypointPath, LabelVersion, Version)
+}
+
+// onionCatImageTag returns the content-addressed tag of the OnionCat image.
+func onionCatImageTag() string {
+	digest := sha256.Sum256([]byte(onionCatDockerfile() + OnionCatEntrypoint))
+	return OnionCatRepository + ":" + hex.EncodeToString(digest[:])[:12]
+}
+
+// EnsureOnionCatImage makes sure that the OnionCat image exists, building it
+// if it doesn't. Like the Tor image, it is never removed.
+func EnsureOnionCatImage(cli *client.Client) (string, error) {
+	tag := onionCatImageTag()
+	if inspect, _, err := cli.ImageInspectWithRaw(tag, false); err == nil {
+		log.Infof("using existing %s image", tag)
+		return inspect.ID, nil
+	} else if !client.IsErrImageNotFound(err) {
+		return "", err
+	}
+
+	ctx, err := buildctx.Archive([]*buildctx.Entry{
+		buildctx.File("Dockerfile", 0644, []byte(onionCatDockerfile())),
+		buildctx.File("mkonion-onioncat", 0755, []byte(OnionCatEntrypoint)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("making build context: %s", err)
+	}
+
+	return buildTorImage(cli, tag, ctx)
+}
+
+// onionCatName returns the name of the OnionCat container of an onion service.
+func onionCatName(ident string) string {
+	return ident + "_onioncat"
+}
+
+// onionCatAlias returns the alias of the OnionCat container on the onion
+// network of an onion service.
+func onionCatAlias(ident string) string {
+	return targetAlias(ident) + "-onioncat"
+}
+
+// OnionCatAddress returns the IPv6 address OnionCat uses for an onion address,
+// which is the OnionCat prefix followed by the first 80 bits of the onion
+// address.
+func OnionCatAddress(onion string) (string, error) {
+	name := strings.ToUpper(strings.TrimSuffix(onion, ".onion"))
+	data, err := base32.StdEncoding.DecodeString(name)
+	if err != nil || len(data) < 10 {
+		return "", fmt.Errorf("invalid onion address '%s'", onion)
+	}
+
+	ip := make(net.IP, 0, net.IPv6len)
+	ip = append(ip, onionCatPrefix...)
+	ip = append(ip, data[:10]...)
+	return ip.String(), nil
+}
+
+// isOnionCatTarget returns whether a HiddenServicePort line of an onion service
+// forwards to its OnionCat container rather than the target.
+func isOnionCatTarget(labels *ServiceLabels, target TargetIP) bool {
+	return labels != nil && labels.OnionCat != "" && target.ExternalPort == OnionCatPort
+}
+
+// splitUDPMappings splits port mappings into TCP mappings and UDP mappings (with
+// their /udp suffix removed).
+func splitUDPMappings(mappings []string) (tcp, udp []string) {
+	for _, arg := range mappings {
+		if strings.HasSuffix(arg, "/udp") {
+			udp = append(udp, strings.TrimSuffix(arg, "/udp"))
+		} else {
+			tcp = append(tcp, arg)
+		}
+	}
+	return tcp, udp
+}
+
+// splitUDPPorts splits exposed ports into UDP ports and everything else.
+func splitUDPPorts(ports []nat.Port) (other, udp []nat.Port) {
+	for _, port := range ports {
+		if port.Proto() == "udp" {
+			udp = append(udp, port)
+		} else {
+			other = append(other, port)
+		}
+	}
+	return other, udp
+}
+
+// BuildUDPPortMappings is like BuildPortMappings, but for the UDP ports
+// forwarded by OnionCat.
+func BuildUDPPortMappings(ports []nat.Port, mappings []string) (map[string]string, error) {
+	portMappings := map[string]string{}
+	for _, port := range ports {
+		log.Infof("forwarding port with onioncat: %s", port)
+		portMappings[port.Port()] = port.Port()
+	}
+
+	for _, arg := range mappings {
+		ports := strings.SplitN(arg, ":", 2)
+		onion, container := ports[0], ports[len(ports)-1]
+		if _, ok := portMappings[onion]; ok {
+			return nil, fmt.Errorf("cannot have multiple definitons of onion port mappings")
+		}
+		portMappings[onion] = container
+	}
+
+	if len(portMappings) == 0 {
+		return nil, fmt.Errorf("onioncat needs at least one UDP port to forward")
+	}
+	return portMappings, nil
+}
+
+// RunOnionCat creates and starts the OnionCat container of an onion service,
+// and connects it to the onion network. Every step is registered with the
+// given transaction.
+func RunOnionCat(cli *client.Client, txn *Transaction, ident, networkID, imageID string, labels map[string]string) (string, error) {
+	resp, err := cli.ContainerCreate(&containerTypes.Config{
+		Image:  imageID,
+		Labels: labels,
+	}, &containerTypes.HostConfig{
+		// OnionCat needs a tun device.
+		CapAdd: strslice.New("NET_ADMIN"),
+		Resources: containerTypes.Resources{
+			Devices: []containerTypes.DeviceMapping{{
+				PathOnHost:        "/dev/net/tun",
+				PathInContainer:   "/dev/net/tun",
+				CgroupPermissions: "rwm",
+			}},
+		},
+	}, nil, onionCatName(ident))
+	if err != nil {
+		return "", err
+	}
+	txn.Add("onioncat create", func() error {
+		return cli.ContainerRemove(types.ContainerRemoveOptions{
+			ContainerID: resp.ID,
+			Force:       true,
+		})
+	})
+
+	for _, warning := range resp.Warnings {
+		log.Warn(warning)
+	}
+
+	if err := cli.ContainerStart(resp.ID); err != nil {
+		return "", err
+	}
+	txn.Add("onioncat start", func() error {
+		return cli.ContainerStop(resp.ID, 10)
+	})
+
+	if err := cli.NetworkConnect(networkID, resp.ID, &networkTypes.EndpointSettings{
+		Aliases: []string{onionCatAlias(ident)},
+	}); err != nil {
+		return "", err
+	}
+	txn.Add("onioncat connect", func() error {
+		return cli.NetworkDisconnect(networkID, resp.ID, true)
+	})
+
+	return resp.ID, nil
+}
+
+// onionCatConfig returns the configuration of the OnionCat container, which is
+// sourced by its entrypoint.
+func onionCatConfig(ident, onion, address string, udpPorts map[string]string) []byte {
+	var onions []string
+	for port := range udpPorts {
+		onions = append(onions, port)
+	}
+	sort.Strings(onions)
+
+	var mappings []string
+	for _, port := range onions {
+		mappings = append(mappings, port+":"+udpPorts[port])
+	}
+
+	vars := [][2]string{
+		{"ONION", onion},
+		{"ADDRESS", address},
+		{"ONIONCAT_PORT", OnionCatPort},
+		{"TARGET", targetAlias(ident)},
+		{"UDP_PORTS", strings.Join(mappings, " ")},
+	}
+
+	config := new(strings.Builder)
+	for _, v := range vars {
+		fmt.Fprintf(config, "%s=%s\n", v[0], shellQuote(v[1]))
+	}
+	return []byte(config.String())
+}
+
+// waitForOnionCat waits until the tunnel interface of an OnionCat container
+// has the given address, or the container exits.
+func waitForOnionCat(cli *client.Client, containerID, address string) error {
+	check := []string{"sh", "-c", `ip -6 addr show | grep -q " $1/"`, "sh", address}
+
+	deadline := time.Now().Add(onionCatTimeout)
+	for {
+		inspect, err := cli.ContainerInspect(containerID)
+		if err != nil {
+			return fmt.Errorf("error inspecting container: %s", err)
+		}
+		if !isRunning(inspect.State) {
+			return fmt.Errorf("onioncat container exited with status %d before the tunnel was up", inspect.State.ExitCode)
+		}
+
+		err = execInContainer(cli, containerID, check)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tunnel interface never got address %s", address)
+		}
+
+		log.Debugf("onioncat tunnel not up yet (%s), retrying after a short nap...", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// ConfigureOnionCat copies the configuration into a running OnionCat container
+// once the onion address is known, and waits for it to bring up the tunnel. It
+// returns the IPv6 address of the onion service.
+func ConfigureOnionCat(cli *client.Client, containerID, ident, onion string, udpPorts map[string]string) (string, error) {
+	address, err := OnionCatAddress(onion)
+	if err != nil {
+		return "", err
+	}
+
+	if err := copyFilesToContainer(cli, containerID, path.Dir(OnionCatConfigPath), []*buildctx.Entry{
+		buildctx.File(path.Base(OnionCatConfigPath), 0644, onionCatConfig(ident, onion, address, udpPorts)),
+	}); err != nil {
+		return "", fmt.Errorf("copying onioncat config: %s", err)
+	}
+
+	if err := waitForOnionCat(cli, containerID, address); err != nil {
+		return "", err
+	}
+	return address, nil
+}
+
+// RemoveOnionCat removes the OnionCat container of an onion service, if it
+// still exists.
+func RemoveOnionCat(cli *client.Client, name string) error {
+	log.Infof("removing onioncat container %s", name)
+	err := cli.ContainerRemove(types.ContainerRemoveOptions{
+		ContainerID: name,
+		Force:       true,
+	})
+	if err != nil && !client.IsErrContainerNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// With -output, the result of creating an onion service is written to stdout as
+// a single document, so scripts don't have to scrape the logs (which always go
+// to stderr).
+
+// OutputFormats are the formats supported by WriteResult.
+var OutputFormats = []string{"json", "yaml", "env"}
+
+// ValidateOutputFormat checks that the output format is supported. An empty
+// format means no output.
+func ValidateOutputFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	for _, supported := range OutputFormats {
+		if format == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format '%s', must be one of %s", format, strings.Join(OutputFormats, ", "))
+}
+
+// shellQuote quotes a value so it can be safely used in a POSIX shell.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// envName converts a service name into the form used in environment variable
+// names.
+func envName(name string) string {
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// writeEnv writes the result as shell variable assignments, which can be
+// loaded with eval. Each named service gets its own MKONION_SERVICE_<NAME>_*
+// variables.
+func writeEnv(w io.Writer, result *CreateResult) error {
+	vars := [][2]string{
+		{"MKONION_IDENT", result.Ident},
+		{"MKONION_NETWORK", result.Network},
+		{"MKONION_NETWORK_ID", result.NetworkID},
+		{"MKONION_CONTAINER_ID", result.ContainerID},
+		{"MKONION_TARGET", result.Target},
+		{"MKONION_TARGET_IP", result.TargetIP},
+	}
+	if result.Onion != "" {
+		vars = append(vars,
+			[2]string{"MKONION_ONION", result.Onion},
+			[2]string{"MKONION_PORTS", formatPorts(result.Ports)})
+	}
+	if result.OnionCat != "" {
+		vars = append(vars,
+			[2]string{"MKONION_ONIONCAT", result.OnionCat},
+			[2]string{"MKONION_UDP_PORTS", formatPorts(result.UDPPorts)})
+	}
+
+	var names []string
+	for _, svc := range result.Services {
+		prefix := "MKONION_SERVICE_" + envName(svc.Name)
+		vars = append(vars,
+			[2]string{prefix + "_ONION", svc.Onion},
+			[2]string{prefix + "_PORTS", formatPorts(svc.Ports)})
+		names = append(names, svc.Name)
+	}
+	if len(names) > 0 {
+		vars = append(vars, [2]string{"MKONION_SERVICES", strings.Join(names, " ")})
+	}
+
+	for _, v := range vars {
+		if _, err := fmt.Fprintf(w, "%s=%s\n", v[0], shellQuote(v[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteResult writes the result of creating an onion service in the given
+// format.
+func WriteResult(w io.Writer, format string, result *CreateResult) error {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(result, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case "yaml":
+		data, err := yaml.Marshal(result)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case "env":
+		return writeEnv(w, result)
+	}
+	return fmt.Errorf("unknown output format '%s'", format)
+}
@@ -0,0 +1,371 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	containerTypes "github.com/docker/engine-api/types/container"
+	"github.com/docker/engine-api/types/filters"
+)
+
+// By default, the hidden_service directory lives in the writable layer of the
+// Tor container, so recreating the container loses the onion address. If the
+// user asks for it, we back the directory with a named volume derived from the
+// target container so the same address is used every time.
+
+// CreateKeyVolume creates the named volume used to persist the hidden_service
+// directory for a target. If the volume already exists it is reused, and
+// created is false.
+func CreateKeyVolume(cli *client.Client, txn *Transaction, name string) (created bool, err error) {
+	if _, err := cli.VolumeInspect(name); err == nil {
+		return false, nil
+	} else if !client.IsErrVolumeNotFound(err) {
+		return false, err
+	}
+
+	if _, err := cli.VolumeCreate(types.VolumeCreateRequest{
+		Name:   name,
+		Driver: "local",
+	}); err != nil {
+		return false, err
+	}
+	txn.Add("volume create", func() error {
+		return cli.VolumeRemove(name)
+	})
+
+	return true, nil
+}
+
+// VolumeKeys fills in the keys of the given services from an existing key
+// volume, so that recreating an onion service keeps its onion addresses. It is
+// an error for a service to have a different key to the one in the volume,
+// since copying it in would clobber the key in the volume. The volume is read
+// using the given image (see copyHiddenServiceDir).
+func VolumeKeys(cli *client.Client, name, imageID string, services []*ServiceOptions) ([]*ServiceOptions, error) {
+	content, err := copyHiddenServiceDir(cli, &OnionService{
+		Ident:  name,
+		Labels: &ServiceLabels{Volume: name},
+	}, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("reading volume %s: %s", name, err)
+	}
+	defer content.Close()
+
+	// The archive is read once for every service.
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, fmt.Errorf("reading volume %s: %s", name, err)
+	}
+
+	var result []*ServiceOptions
+	for _, svc := range services {
+		key, err := findOnionKey(bytes.NewReader(data), svc.Name)
+		if err != nil {
+			return nil, fmt.Errorf("reading key from volume %s: %s", name, err)
+		}
+
+		if key != nil {
+			if svc.Key != nil && !bytes.Equal(key.Secret, svc.Key.Secret) {
+				return nil, fmt.Errorf("key volume %s already has a different key", name)
+			}
+			copied := *svc
+			copied.Key = key
+			svc = &copied
+		}
+		result = append(result, svc)
+	}
+	return result, nil
+}
+
+// localImage returns an image which already exists locally, for creating
+// containers which are never started. The Tor image is used if it exists,
+// otherwise the image of any container created by mkonion. If there is no
+// such image, "" is returned.
+func localImage(cli *client.Client) (string, error) {
+	options := DefaultImageOptions()
+	ref := options.Image
+	if ref == "" {
+		dockerfile, err := generateDockerfile(options)
+		if err != nil {
+			return "", fmt.Errorf("generating dockerfile: %s", err)
+		}
+		ref = torImageTag(dockerfile)
+	}
+	if inspect, _, err := cli.ImageInspectWithRaw(ref, false); err == nil {
+		return inspect.ID, nil
+	} else if !client.IsErrImageNotFound(err) {
+		return "", err
+	}
+
+	args := filters.NewArgs()
+	args.Add("label", LabelVersion)
+	containers, err := cli.ContainerList(types.ContainerListOptions{
+		All:    true,
+		Filter: args,
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, container := range containers {
+		if container.ImageID != "" {
+			return container.ImageID, nil
+		}
+	}
+	return "", nil
+}
+
+// copyHiddenServiceDir returns a tar archive of the hidden_service directory
+// of an onion service. If the Tor container no longer exists, the directory is
+// read from the persistent volume (if there is one) using a temporary
+// container created from the given image, or from an image which already
+// exists locally if none is given. The caller must close the returned reader.
+func copyHiddenServiceDir(cli *client.Client, svc *OnionService, imageID string) (io.ReadCloser, error) {
+	if svc.ContainerID != "" {
+		// The shared Tor daemon has the keys of other onion services, so
+		// only copy the directory of this one.
+		dir := HiddenServiceDir
+		if svc.Labels != nil && svc.Labels.Daemon != "" {
+			dir = path.Join(HiddenServiceDir, svc.Ident)
+		}
+
+		content, _, err := cli.CopyFromContainer(svc.ContainerID, dir)
+		return content, err
+	}
+
+	if svc.Labels == nil || svc.Labels.Volume == "" {
+		return nil, fmt.Errorf("onion service %s has no Tor container or persistent volume", svc.Ident)
+	}
+
+	// Building or pulling an image just to read a volume isn't worth it.
+	if imageID == "" {
+		var err error
+		imageID, err = localImage(cli)
+		if err != nil {
+			return nil, fmt.Errorf("finding image: %s", err)
+		}
+		if imageID == "" {
+			return nil, fmt.Errorf("no local image to read volume %s with, create an onion service first", svc.Labels.Volume)
+		}
+	}
+
+	// We need a container to copy from, but it never has to be started.
+	resp, err := cli.ContainerCreate(&containerTypes.Config{
+		Image: imageID,
+	}, &containerTypes.HostConfig{
+		Binds: []string{svc.Labels.Volume + ":" + HiddenServiceDir},
+	}, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary container: %s", err)
+	}
+	defer func() {
+		if err := cli.ContainerRemove(types.ContainerRemoveOptions{
+			ContainerID: resp.ID,
+			Force:       true,
+		}); err != nil {
+			log.Warnf("removing temporary container: %s", err)
+		}
+	}()
+
+	content, _, err := cli.CopyFromContainer(resp.ID, HiddenServiceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The container is removed once we return, so buffer the archive.
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// findOnionKey reads the keypair of the named service from a tar archive of a
+// hidden_service directory. If the service has no key, nil is returned.
+func findOnionKey(content io.Reader, name string) (*OnionKey, error) {
+	tr := tar.NewReader(content)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The archive is rooted at the hidden_service directory itself.
+		parts := strings.SplitN(path.Clean(hdr.Name), "/", 2)
+		if len(parts) != 2 || path.Clean(parts[1]) != path.Join(hiddenServiceSubdir(name), SecretKeyFile) {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		return ParseSecretKey(data)
+	}
+
+	return nil, nil
+}
+
+// ExportOnionKey reads the keypair of an onion service. If the Tor container
+// runs several onion services, name selects which one.
+func ExportOnionKey(cli *client.Client, svc *OnionService, name string) (*OnionKey, error) {
+	content, err := copyHiddenServiceDir(cli, svc, "")
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	key, err := findOnionKey(content, name)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%s not found in hidden_service directory", SecretKeyFile)
+	}
+	return key, nil
+}
+
+// findKeyService is like FindOnionService, but requires the name to match
+// exactly one onion service. If the onion service has already been removed,
+// but its persistent volume is still around, we return a stub service that
+// refers to the volume.
+func findKeyService(cli *client.Client, name string) (*OnionService, error) {
+	svcs, err := FindOnionService(cli, name)
+	if err != nil {
+		volume := persistentVolumeName(name)
+		if _, err := cli.VolumeInspect(volume); err == nil {
+			return &OnionService{
+				Ident:  volume,
+				Labels: &ServiceLabels{Volume: volume},
+			}, nil
+		}
+		return nil, err
+	}
+	if len(svcs) != 1 {
+		return nil, fmt.Errorf("'%s' matches %d onion services, use the identifier instead", name, len(svcs))
+	}
+	return svcs[0], nil
+}
+
+func cmdKey(args []string) error {
+	subcommands := map[string]func(args []string) error{
+		"export": cmdKeyExport,
+		"backup": cmdKeyBackup,
+	}
+
+	if len(args) == 0 || subcommands[args[0]] == nil {
+		fmt.Fprintf(os.Stderr, "usage: %s key export [-service name] <ident|target> <dir>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s key backup <ident|target> <file>\n", os.Args[0])
+		return fmt.Errorf("must specify a valid key subcommand")
+	}
+
+	return subcommands[args[0]](args[1:])
+}
+
+func cmdKeyExport(args []string) error {
+	var oService string
+
+	flags := newFlagSet("key export", "[-service name] <ident|target> <dir>")
+	flags.StringVar(&oService, "service", "", "export the key of the given named onion service")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("must specify an onion service and a directory")
+	}
+	dir := flags.Arg(1)
+
+	if _, err := os.Stat(filepath.Join(dir, SecretKeyFile)); err == nil {
+		return fmt.Errorf("%s already contains a %s", dir, SecretKeyFile)
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	svc, err := findKeyService(cli, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	key, err := ExportOnionKey(cli, svc, oService)
+	if err != nil {
+		return fmt.Errorf("exporting key: %s", err)
+	}
+
+	if err := WriteOnionKey(dir, key); err != nil {
+		return fmt.Errorf("writing key: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"ident": svc.Ident,
+		"dir":   dir,
+	}).Info("exported onion key")
+	fmt.Println(key.Hostname())
+	return nil
+}
+
+func cmdKeyBackup(args []string) error {
+	flags := newFlagSet("key backup", "<ident|target> <file>")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("must specify an onion service and a file (or - for stdout)")
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	svc, err := findKeyService(cli, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	content, err := copyHiddenServiceDir(cli, svc, "")
+	if err != nil {
+		return fmt.Errorf("copying hidden_service directory: %s", err)
+	}
+	defer content.Close()
+
+	out := os.Stdout
+	if flags.Arg(1) != "-" {
+		out, err = os.OpenFile(flags.Arg(1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	if _, err := io.Copy(out, content); err != nil {
+		return fmt.Errorf("writing backup: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"ident": svc.Ident,
+	}).Info("backed up hidden_service directory")
+	return nil
+}
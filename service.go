@@ -0,0 +1,394 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+)
+
+// OnionService describes an onion service created by mkonion, as recovered
+// from the state of the Docker daemon. The onion network and the Tor container
+// share the same identifier, which is how we tie the two together.
+type OnionService struct {
+	Ident       string   `json:"ident"`
+	NetworkID   string   `json:"network_id"`
+	ContainerID string   `json:"container_id,omitempty"`
+	ImageID     string   `json:"image_id,omitempty"`
+	Status      string   `json:"status"`
+	Targets     []string `json:"targets"`
+	Onion       string   `json:"onion,omitempty"`
+	// OnionCat is the IPv6 address of the onion service, if its UDP ports are
+	// forwarded by OnionCat.
+	OnionCat string `json:"onioncat,omitempty"`
+	// Services maps the names of each onion service to its onion address,
+	// for Tor containers running several onion services.
+	Services map[string]string `json:"services,omitempty"`
+	// Reused is set if the onion service was created on an existing network
+	// rather than its own onion network, so the network isn't ours to remove.
+	Reused bool `json:"reused,omitempty"`
+	// Updated is set if the ports of the onion service were changed by
+	// `mkonion update`. The ports in its labels are read back from its torrc,
+	// as the labels themselves still describe it as it was created.
+	Updated bool           `json:"updated,omitempty"`
+	Labels  *ServiceLabels `json:"labels,omitempty"`
+}
+
+// ServesTarget returns whether the container with the given name is one of
+// the targets connected to the onion network of the service.
+func (svc *OnionService) ServesTarget(target string) bool {
+	for _, t := range svc.Targets {
+		if strings.TrimPrefix(t, "/") == strings.TrimPrefix(target, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectOnionService fills in the information about a single onion service
+// from its network. The network is normally the onion network of the service
+// (named after its identifier), but it can also be an existing network shared
+// with other containers.
+func inspectOnionService(cli *client.Client, ident string, network types.NetworkResource) (*OnionService, error) {
+	reused := network.Name != ident
+	svc := &OnionService{
+		Ident:     ident,
+		NetworkID: network.ID,
+		Status:    "missing",
+		Reused:    reused,
+	}
+
+	// Services created by older versions of mkonion don't have any labels.
+	if labels, err := ParseServiceLabels(network.Options); err == nil && !reused {
+		svc.Labels = labels
+	}
+
+	// Everything on the onion network except for the Tor and OnionCat
+	// containers is a target. On a reused network, only the target is.
+	for _, endpoint := range network.Containers {
+		if reused || endpoint.Name == ident || endpoint.Name == SharedDaemonName || endpoint.Name == onionCatName(ident) {
+			continue
+		}
+		svc.Targets = append(svc.Targets, endpoint.Name)
+	}
+	sort.Strings(svc.Targets)
+
+	// Services served by the shared Tor daemon don't have their own Tor
+	// container, and live in a directory named after their identifier.
+	daemon, dir := svc.Ident, ""
+	if svc.Labels != nil && svc.Labels.Daemon != "" {
+		daemon, dir = svc.Labels.Daemon, svc.Ident
+	}
+
+	// The Tor container might not be connected to the network if something
+	// went wrong while setting it up, so look it up by name.
+	inspect, err := cli.ContainerInspect(daemon)
+	if err != nil {
+		if client.IsErrContainerNotFound(err) {
+			return svc, nil
+		}
+		return nil, err
+	}
+
+	svc.ContainerID = inspect.ID
+	svc.ImageID = inspect.Image
+	svc.Status = inspect.State.Status
+
+	// The container labels take precedence over the network labels.
+	if inspect.Config != nil {
+		if labels, err := ParseServiceLabels(inspect.Config.Labels); err == nil {
+			svc.Labels = labels
+		}
+	}
+
+	if svc.Labels != nil && svc.Labels.Daemon == "" && !svc.Labels.Ephemeral {
+		updated, err := readTorrcPorts(cli, svc.ContainerID, svc.Labels)
+		if err != nil {
+			log.Warnf("read ports of %s from torrc: %s", svc.Ident, err)
+		}
+		svc.Updated = updated
+	}
+
+	if reused && svc.Labels != nil {
+		for _, endpoint := range network.Containers {
+			if endpoint.Name == svc.Labels.TargetName {
+				svc.Targets = append(svc.Targets, endpoint.Name)
+			}
+		}
+	}
+
+	if svc.Labels != nil && len(svc.Labels.Services) > 0 {
+		svc.Services = map[string]string{}
+		for name, labels := range svc.Labels.Services {
+			svc.Services[name] = labels.Onion
+			if labels.Onion == "" && isRunning(inspect.State) {
+				onion, err := GetOnionHostname(cli, svc.ContainerID, name)
+				if err != nil {
+					log.Warnf("get onion hostname of %s/%s: %s", svc.Ident, name, err)
+				}
+				svc.Services[name] = onion
+			}
+		}
+	} else if svc.Labels != nil && svc.Labels.Onion != "" {
+		svc.Onion = svc.Labels.Onion
+	} else if svc.Labels != nil && svc.Labels.Ephemeral {
+		// Ephemeral onion services have no hidden_service directory, so ask
+		// Tor directly.
+		if isRunning(inspect.State) {
+			onion, err := getEphemeralOnion(cli, svc.ContainerID)
+			if err != nil {
+				log.Warnf("get onion address of %s: %s", svc.Ident, err)
+			}
+			svc.Onion = onion
+		}
+	} else if isRunning(inspect.State) {
+		onion, err := GetOnionHostname(cli, svc.ContainerID, dir)
+		if err != nil {
+			log.Warnf("get onion hostname of %s: %s", svc.Ident, err)
+		}
+		svc.Onion = onion
+	}
+
+	if svc.Labels != nil && svc.Labels.OnionCat != "" && svc.Onion != "" {
+		if address, err := OnionCatAddress(svc.Onion); err == nil {
+			svc.OnionCat = address
+		}
+	}
+
+	return svc, nil
+}
+
+// getEphemeralOnion asks the Tor daemon in the given container for the address
+// of the ephemeral onion service it is running.
+func getEphemeralOnion(cli *client.Client, containerID string) (string, error) {
+	ctrl, err := DialControl(cli, containerID)
+	if err != nil {
+		return "", err
+	}
+	defer ctrl.Close()
+
+	onions, err := ctrl.DetachedOnions()
+	if err != nil {
+		return "", err
+	}
+	if len(onions) != 1 {
+		return "", fmt.Errorf("expected one ephemeral onion service, tor has %d", len(onions))
+	}
+	return onions[0], nil
+}
+
+// listOnionNetworks returns the onion networks created by mkonion.
+func listOnionNetworks(cli *client.Client) ([]types.NetworkResource, error) {
+	args := filters.NewArgs()
+	args.Add("name", identifierPrefix)
+
+	networks, err := cli.NetworkList(types.NetworkListOptions{
+		Filters: args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The name filter matches substrings, so we need to check the prefix.
+	var onionNetworks []types.NetworkResource
+	for _, network := range networks {
+		if strings.HasPrefix(network.Name, identifierPrefix) {
+			onionNetworks = append(onionNetworks, network)
+		}
+	}
+	return onionNetworks, nil
+}
+
+// listReusedServices returns the Tor containers of onion services created on
+// an existing network, which don't have an onion network of their own.
+func listReusedServices(cli *client.Client) ([]types.Container, error) {
+	args := filters.NewArgs()
+	args.Add("label", LabelNetwork)
+
+	return cli.ContainerList(types.ContainerListOptions{
+		All:    true,
+		Filter: args,
+	})
+}
+
+// containerName returns the name of a container in a container listing.
+func containerName(container types.Container) string {
+	if len(container.Names) == 0 {
+		return container.ID
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
+
+// FindOnionServices returns the set of onion services created by mkonion that
+// currently exist on the Docker daemon.
+func FindOnionServices(cli *client.Client) ([]*OnionService, error) {
+	networks, err := listOnionNetworks(cli)
+	if err != nil {
+		return nil, err
+	}
+
+	var svcs []*OnionService
+	for _, network := range networks {
+		svc, err := inspectOnionService(cli, network.Name, network)
+		if err != nil {
+			return nil, fmt.Errorf("inspect onion service %s: %s", network.Name, err)
+		}
+		svcs = append(svcs, svc)
+	}
+
+	containers, err := listReusedServices(cli)
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		ident := containerName(container)
+
+		// The network might have been removed from under us, in which case
+		// there's nothing left to inspect but the Tor container.
+		network, err := cli.NetworkInspect(container.Labels[LabelNetwork])
+		if err != nil && !client.IsErrNetworkNotFound(err) {
+			return nil, fmt.Errorf("inspect onion service %s: %s", ident, err)
+		}
+
+		svc, err := inspectOnionService(cli, ident, network)
+		if err != nil {
+			return nil, fmt.Errorf("inspect onion service %s: %s", ident, err)
+		}
+		svcs = append(svcs, svc)
+	}
+
+	return svcs, nil
+}
+
+// FindOnionService returns the onion services which match the given name. The
+// name can either be the identifier of the service, or the name (or ID) of one
+// of the target containers.
+func FindOnionService(cli *client.Client, name string) ([]*OnionService, error) {
+	svcs, err := FindOnionServices(cli)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve the target to its canonical name and ID if we can, so that IDs
+	// (and partial IDs) of the target also match. The target might have been
+	// removed, in which case we can still match against the labels.
+	targetName, targetID := strings.TrimPrefix(name, "/"), ""
+	if inspect, err := cli.ContainerInspect(name); err == nil {
+		targetName, targetID = strings.TrimPrefix(inspect.Name, "/"), inspect.ID
+	}
+
+	var matches []*OnionService
+	for _, svc := range svcs {
+		match := svc.Ident == name || svc.ServesTarget(targetName)
+		if labels := svc.Labels; labels != nil {
+			match = match || labels.TargetName == targetName || (targetID != "" && labels.Target == targetID)
+		}
+
+		if match {
+			matches = append(matches, svc)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no onion service found for '%s'", name)
+	}
+	return matches, nil
+}
+
+// findSingleService is like FindOnionService, but requires the name to match
+// exactly one onion service with a Tor container.
+func findSingleService(cli *client.Client, name string) (*OnionService, error) {
+	svcs, err := FindOnionService(cli, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(svcs) != 1 {
+		return nil, fmt.Errorf("'%s' matches %d onion services, use the identifier instead", name, len(svcs))
+	}
+	if svcs[0].ContainerID == "" {
+		return nil, fmt.Errorf("onion service %s has no tor container", svcs[0].Ident)
+	}
+	return svcs[0], nil
+}
+
+// RemoveOnionService tears down all of the resources associated with an onion
+// service: the Tor container (and OnionCat container) and the onion network.
+// The Tor image (and the shared Tor daemon) are shared between onion services,
+// so they are left alone.
+// The persistent key volume is only removed if removeVolume is set, as
+// removing it loses the onion address forever.
+func RemoveOnionService(cli *client.Client, svc *OnionService, removeVolume bool) error {
+	if svc.Labels != nil && svc.Labels.Daemon != "" {
+		return RemoveSharedService(cli, svc)
+	}
+
+	// The DNS of an isolated target is restored with a helper container using
+	// the Tor image, so find it before the Tor container is gone.
+	var imageID string
+	if svc.ContainerID != "" && svc.Labels != nil && svc.Labels.Isolate {
+		if inspect, err := cli.ContainerInspect(svc.ContainerID); err != nil {
+			log.Warnf("remove onion service %s: inspecting container: %s", svc.Ident, err)
+		} else {
+			imageID = inspect.Image
+		}
+	}
+
+	if svc.ContainerID != "" {
+		log.Infof("remove onion service %s: removing container %s", svc.Ident, svc.ContainerID)
+		if err := cli.ContainerRemove(types.ContainerRemoveOptions{
+			ContainerID:   svc.ContainerID,
+			RemoveVolumes: true,
+			Force:         true,
+		}); err != nil {
+			return fmt.Errorf("removing container: %s", err)
+		}
+	}
+
+	if svc.Labels != nil && svc.Labels.OnionCat != "" {
+		if err := RemoveOnionCat(cli, svc.Labels.OnionCat); err != nil {
+			return fmt.Errorf("removing onioncat container: %s", err)
+		}
+	}
+
+	// We never remove a network we didn't create, even if the labels of the
+	// onion service are missing.
+	if svc.Reused || (svc.Labels != nil && svc.Labels.Network != "") {
+		network := svc.NetworkID
+		if svc.Labels != nil && svc.Labels.Network != "" {
+			network = svc.Labels.Network
+		}
+		log.Infof("remove onion service %s: leaving network %s alone", svc.Ident, network)
+	} else if err := PurgeOnionNetwork(cli, svc.NetworkID); err != nil {
+		return fmt.Errorf("purging network: %s", err)
+	}
+
+	// An isolated target has no other networks, so give them back.
+	if svc.Labels != nil && svc.Labels.Isolate {
+		ReconnectTarget(cli, svc.Labels)
+		if imageID == "" {
+			log.Warnf("remove onion service %s: no tor image to restore the dns of the target with", svc.Ident)
+		} else if err := RestoreTargetDNS(cli, imageID, svc.Labels.TargetRef()); err != nil {
+			log.Warnf("remove onion service %s: restoring dns of target: %s", svc.Ident, err)
+		}
+	}
+
+	if removeVolume && svc.Labels != nil && svc.Labels.Volume != "" {
+		log.Infof("remove onion service %s: removing volume %s", svc.Ident, svc.Labels.Volume)
+		if err := cli.VolumeRemove(svc.Labels.Volume); err != nil {
+			return fmt.Errorf("removing volume: %s", err)
+		}
+	}
+
+	return nil
+}
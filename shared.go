@@ -0,0 +1,289 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	containerTypes "github.com/docker/engine-api/types/container"
+)
+
+// Running a Tor container per onion service is quite heavy if you have lots of
+// small services. In shared mode, a single long-lived Tor container is attached
+// to the onion network of every shared onion service, and its torrc has one
+// HiddenServiceDir per service (named after the identifier of the service).
+// Every shared onion service still gets its own onion network, so targets are
+// still isolated from each other.
+//
+// The torrc of the shared daemon is never stored anywhere. It is regenerated
+// from the labels of the onion networks whenever a service is added or removed,
+// after which Tor is reloaded with SIGHUP.
+
+// SharedDaemonName is the name of the shared Tor container.
+const SharedDaemonName = identifierPrefix + "shared"
+
+// execInContainer runs a command inside a running container and waits for it
+// to finish.
+func execInContainer(cli *client.Client, containerID string, cmd []string) error {
+	exec, err := cli.ContainerExecCreate(types.ExecConfig{
+		Container: containerID,
+		Cmd:       cmd,
+		Detach:    true,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := cli.ContainerExecStart(exec.ID, types.ExecStartCheck{
+		Detach: true,
+	}); err != nil {
+		return err
+	}
+
+	// XXX: There's no way to wait for an exec to finish other than polling.
+	for {
+		inspect, err := cli.ContainerExecInspect(exec.ID)
+		if err != nil {
+			return err
+		}
+
+		if !inspect.Running {
+			if inspect.ExitCode != 0 {
+				return fmt.Errorf("%s exited with status %d", strings.Join(cmd, " "), inspect.ExitCode)
+			}
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// EnsureSharedDaemon makes sure the shared Tor container exists and is
+// running, creating it if it doesn't exist. Like the Tor image, the shared Tor
+// container is never removed by rollbacks.
+func EnsureSharedDaemon(cli *client.Client, image *ImageOptions) (string, error) {
+	if inspect, err := cli.ContainerInspect(SharedDaemonName); err == nil {
+		if !isRunning(inspect.State) {
+			log.Infof("starting shared tor daemon %s", SharedDaemonName)
+			if err := cli.ContainerStart(inspect.ID); err != nil {
+				return "", err
+			}
+		}
+		return inspect.ID, nil
+	} else if !client.IsErrContainerNotFound(err) {
+		return "", err
+	}
+
+	imageID, err := EnsureTorImage(cli, image)
+	if err != nil {
+		return "", fmt.Errorf("getting image: %s", err)
+	}
+
+	// Tor is happy to run without any onion services, so the shared daemon
+	// starts out empty.
+	torrc, err := GenerateConfig(cli, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("generating torrc: %s", err)
+	}
+
+	resp, err := cli.ContainerCreate(&containerTypes.Config{
+		Image: imageID,
+		Labels: map[string]string{
+			LabelDaemon:  SharedDaemonName,
+			LabelVersion: Version,
+			LabelCreated: time.Now().UTC().Format(time.RFC3339),
+		},
+	}, &containerTypes.HostConfig{}, nil, SharedDaemonName)
+	if err != nil {
+		return "", err
+	}
+
+	for _, warning := range resp.Warnings {
+		log.Warn(warning)
+	}
+
+	if err := copyTorrcToContainer(cli, resp.ID, torrc); err == nil {
+		err = cli.ContainerStart(resp.ID)
+	}
+	if err != nil {
+		if err := cli.ContainerRemove(types.ContainerRemoveOptions{
+			ContainerID: resp.ID,
+			Force:       true,
+		}); err != nil {
+			log.Warnf("removing shared tor daemon: %s", err)
+		}
+		return "", fmt.Errorf("starting shared tor daemon: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"container": resp.ID,
+	}).Infof("started shared tor daemon %s", SharedDaemonName)
+	return resp.ID, nil
+}
+
+// sharedServices returns the Tor configuration of every onion service served
+// by the shared Tor daemon, as recovered from the labels of their onion
+// networks. If aliases is set, the services forward to the aliases of their
+// targets rather than their current addresses.
+func sharedServices(cli *client.Client, aliases bool) ([]TorService, error) {
+	networks, err := listOnionNetworks(cli)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []TorService
+	for _, network := range networks {
+		labels, err := ParseServiceLabels(network.Options)
+		if err != nil || labels.Daemon != SharedDaemonName {
+			continue
+		}
+
+		addr, err := FindOnionIPAddress(cli, labels.TargetRef(), network.Name)
+		if err != nil {
+			log.Warnf("shared tor daemon: skipping onion service %s: %s", network.Name, err)
+			continue
+		}
+		if aliases {
+			addr = targetAlias(network.Name)
+		}
+
+		services = append(services, TorService{
+			Dir:     path.Join(HiddenServiceDir, network.Name),
+			Targets: GenerateTargetMappings(addr, labels.Ports),
+		})
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Dir < services[j].Dir
+	})
+	return services, nil
+}
+
+// ReloadSharedDaemon regenerates the torrc of the shared Tor daemon, copies it
+// into the container and reloads Tor. If the shared Tor daemon doesn't exist,
+// there's nothing to do.
+func ReloadSharedDaemon(cli *client.Client) error {
+	inspect, err := cli.ContainerInspect(SharedDaemonName)
+	if err != nil {
+		if client.IsErrContainerNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	aliases, err := imageResolvesAliases(cli, inspect.Image)
+	if err != nil {
+		return fmt.Errorf("inspecting image: %s", err)
+	}
+
+	services, err := sharedServices(cli, aliases)
+	if err != nil {
+		return fmt.Errorf("finding shared onion services: %s", err)
+	}
+
+	torrc, err := GenerateConfig(cli, services, nil)
+	if err != nil {
+		return fmt.Errorf("generating torrc: %s", err)
+	}
+
+	// Don't bother reloading Tor if nothing has changed. If the torrc uses
+	// aliases, the addresses they resolve to might have changed, so Tor has
+	// to be reloaded anyway.
+	if old, err := readContainerFile(cli, inspect.ID, TorrcPath); err == nil && bytes.Equal(old, torrc) && !aliases {
+		return nil
+	}
+
+	// XXX: Two concurrent runs of mkonion can race here, but since the torrc
+	//      is generated from the state of the daemon, whichever reload happens
+	//      last will include both services.
+	if err := copyTorrcToContainer(cli, inspect.ID, torrc); err != nil {
+		return fmt.Errorf("copying torrc: %s", err)
+	}
+
+	if !isRunning(inspect.State) {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"services": len(services),
+	}).Info("reloading shared tor daemon")
+	return cli.ContainerKill(inspect.ID, "HUP")
+}
+
+// removeSharedServiceDir removes the directory of an onion service from the
+// shared Tor daemon, so that its keys don't outlive it.
+func removeSharedServiceDir(cli *client.Client, containerID, ident string) error {
+	return execInContainer(cli, containerID, []string{"rm", "-rf", path.Join(HiddenServiceDir, ident)})
+}
+
+// AddSharedService adds an onion service to the shared Tor daemon (starting it
+// if necessary), which must already have its onion network set up. Every step
+// is registered with the given transaction. The caller is responsible for
+// reloading the shared daemon once the onion network is removed on rollback.
+func AddSharedService(cli *client.Client, txn *Transaction, ident, networkID string, svc *ServiceOptions, clients map[string]string, image *ImageOptions) (string, error) {
+	containerID, err := EnsureSharedDaemon(cli, image)
+	if err != nil {
+		return "", err
+	}
+
+	if err := cli.NetworkConnect(networkID, containerID, nil); err != nil {
+		return "", fmt.Errorf("connecting shared tor daemon: %s", err)
+	}
+	txn.Add("network connect", func() error {
+		return cli.NetworkDisconnect(networkID, containerID, true)
+	})
+
+	files, err := hiddenServiceFiles(&ServiceOptions{
+		Name: ident,
+		Key:  svc.Key,
+	}, clients)
+	if err != nil {
+		return "", err
+	}
+	if err := copyFilesToContainer(cli, containerID, HiddenServiceDir, files); err != nil {
+		return "", fmt.Errorf("copying hidden service files: %s", err)
+	}
+	txn.Add("copy hidden service files", func() error {
+		return removeSharedServiceDir(cli, containerID, ident)
+	})
+
+	if err := ReloadSharedDaemon(cli); err != nil {
+		return "", fmt.Errorf("reloading shared tor daemon: %s", err)
+	}
+
+	return containerID, nil
+}
+
+// RemoveSharedService removes an onion service from the shared Tor daemon,
+// along with its onion network. The shared Tor daemon itself is left running.
+func RemoveSharedService(cli *client.Client, svc *OnionService) error {
+	if err := PurgeOnionNetwork(cli, svc.NetworkID); err != nil {
+		return fmt.Errorf("purging network: %s", err)
+	}
+
+	if err := ReloadSharedDaemon(cli); err != nil {
+		return fmt.Errorf("reloading shared tor daemon: %s", err)
+	}
+
+	if svc.ContainerID != "" && svc.Status == "running" {
+		log.Infof("remove onion service %s: removing keys from shared tor daemon", svc.Ident)
+		if err := removeSharedServiceDir(cli, svc.ContainerID, svc.Ident); err != nil {
+			return fmt.Errorf("removing keys: %s", err)
+		}
+	}
+
+	return nil
+}
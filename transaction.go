@@ -0,0 +1,115 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Setting up an onion service involves a bunch of steps which each modify the
+// state of the Docker daemon. If any of them fail (or we get interrupted), we
+// need to undo all of the steps that were completed so we don't leave behind
+// a half-configured mess.
+
+type undoStep struct {
+	name string
+	undo func() error
+}
+
+// Transaction is a log of completed steps, each of which has registered a way
+// of undoing itself. Steps are undone in reverse order.
+type Transaction struct {
+	lock  sync.Mutex
+	steps []undoStep
+	done  bool
+}
+
+// NewTransaction creates a new empty transaction.
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+// Add registers a completed step, along with the function to undo it. If the
+// transaction has already been rolled back, the step is undone immediately.
+func (t *Transaction) Add(name string, undo func() error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.done {
+		log.Warnf("rollback: transaction already finished, undoing %s", name)
+		if err := undo(); err != nil {
+			log.Warnf("rollback: %s: %s", name, err)
+		}
+		return
+	}
+
+	t.steps = append(t.steps, undoStep{
+		name: name,
+		undo: undo,
+	})
+}
+
+// Commit marks the transaction as successful, discarding all of the undo
+// steps.
+func (t *Transaction) Commit() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.steps = nil
+	t.done = true
+}
+
+// Rollback undoes every registered step in reverse order. Errors are logged
+// rather than returned, as we want to undo as much as possible.
+func (t *Transaction) Rollback() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		step := t.steps[i]
+		log.Infof("rollback: undoing %s", step.name)
+		if err := step.undo(); err != nil {
+			log.Warnf("rollback: %s: %s", step.name, err)
+		}
+	}
+
+	t.steps = nil
+	t.done = true
+}
+
+// HandleSignals rolls back the transaction and exits if we receive a SIGINT
+// or SIGTERM. The returned function stops handling signals, and should be
+// called once the transaction is finished.
+func (t *Transaction) HandleSignals() func() {
+	sigs := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			// XXX: Any Docker API request that is in-flight right now won't
+			//      have registered its undo step yet, so whatever it creates
+			//      will be leaked. engine-api doesn't let us cancel requests.
+			log.Warnf("received %s, rolling back", sig)
+			t.Rollback()
+			os.Exit(1)
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(stop)
+	}
+}
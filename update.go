@@ -0,0 +1,265 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+)
+
+// `mkonion update` changes the port mappings of a running onion service by
+// regenerating its torrc, copying it into the existing Tor container and
+// reloading Tor. The hidden_service directories are left alone, so the onion
+// addresses don't change. Because labels can't be changed after a container
+// has been created, the current configuration is read back from the torrc in
+// the container rather than from the labels.
+
+// UpdateOptions describes the new configuration of an onion service.
+type UpdateOptions struct {
+	// Mappings is the new list of extra port mappings for an onion service
+	// with a single (unnamed) service, of the form [onion:]container. The
+	// exposed ports of the target are always forwarded.
+	Mappings []string
+	// Services contains the new port mappings of named services. Services
+	// which aren't listed keep their current port mappings.
+	Services []*ServiceOptions
+}
+
+// UpdateOnionService changes the port mappings of a running onion service,
+// without changing its Tor container or its onion addresses. Changes which
+// would need a new key are refused.
+func UpdateOnionService(cli *client.Client, svc *OnionService, options *UpdateOptions) error {
+	if svc.Labels == nil {
+		return fmt.Errorf("onion service %s has no labels, it must be recreated", svc.Ident)
+	}
+	if svc.Labels.Daemon != "" {
+		return fmt.Errorf("onion service %s is served by the shared tor daemon, it must be recreated", svc.Ident)
+	}
+	if svc.Labels.Ephemeral {
+		return fmt.Errorf("onion service %s is ephemeral and tor has discarded its key, it must be recreated", svc.Ident)
+	}
+	if svc.ContainerID == "" {
+		return fmt.Errorf("onion service %s has no tor container", svc.Ident)
+	}
+
+	if err := ValidateMappings(options.Mappings); err != nil {
+		return err
+	}
+	for _, update := range options.Services {
+		if update.Key != nil {
+			return fmt.Errorf("service %s: cannot change the key of an existing onion service", update.Name)
+		}
+		if len(update.Mappings) == 0 {
+			return fmt.Errorf("service %s: must specify at least one port", update.Name)
+		}
+		if err := ValidateMappings(update.Mappings); err != nil {
+			return fmt.Errorf("service %s: %s", update.Name, err)
+		}
+	}
+
+	oldTorrc, err := readContainerFile(cli, svc.ContainerID, TorrcPath)
+	if err != nil {
+		return fmt.Errorf("reading torrc: %s", err)
+	}
+	services, torOptions, err := ParseConfig(oldTorrc)
+	if err != nil {
+		return fmt.Errorf("parsing torrc: %s", err)
+	}
+
+	// The target might have been restarted (and thus have a new address)
+	// since the onion service was created, so always use its current address.
+	ip, err := FindOnionIPAddress(cli, svc.Labels.TargetRef(), svc.Labels.NetworkName())
+	if err != nil {
+		return fmt.Errorf("finding target onion ip: %s", err)
+	}
+
+	// Keep forwarding to the alias of the target if the torrc already does.
+	addr := ip
+	if usesAliases(services) {
+		addr = svc.Labels.TargetAlias()
+	}
+
+	updates := map[string]*ServiceOptions{}
+	for _, update := range options.Services {
+		updates[path.Join(HiddenServiceDir, update.Name)] = update
+	}
+
+	for i := range services {
+		torService := &services[i]
+
+		// Changing the ports of the unnamed service works just like
+		// creating it, so the exposed ports are forwarded too.
+		var portMappings map[string]string
+		switch update, ok := updates[torService.Dir]; {
+		case torService.Dir == HiddenServiceDir:
+			if len(options.Services) > 0 {
+				return fmt.Errorf("onion service %s has no named services", svc.Ident)
+			}
+
+			ports, err := FindTargetPorts(cli, svc.Labels.TargetRef())
+			if err != nil {
+				return fmt.Errorf("finding target ports: %s", err)
+			}
+			// The UDP ports forwarded by OnionCat can't be changed.
+			if svc.Labels.OnionCat != "" {
+				ports, _ = splitUDPPorts(ports)
+			}
+			portMappings, err = BuildPortMappings(ports, options.Mappings)
+			if err != nil {
+				return err
+			}
+		case ok:
+			portMappings, err = BuildPortMappings(nil, update.Mappings)
+			if err != nil {
+				return fmt.Errorf("service %s: %s", update.Name, err)
+			}
+			delete(updates, torService.Dir)
+		default:
+			portMappings = map[string]string{}
+			for _, target := range torService.Targets {
+				if !isOnionCatTarget(svc.Labels, target) {
+					portMappings[target.ExternalPort] = target.InternalPort
+				}
+			}
+		}
+
+		// Keep forwarding to OnionCat, which isn't the target.
+		var onionCatTargets []TargetIP
+		for _, target := range torService.Targets {
+			if isOnionCatTarget(svc.Labels, target) {
+				onionCatTargets = append(onionCatTargets, target)
+			}
+		}
+		if _, ok := portMappings[OnionCatPort]; ok && len(onionCatTargets) > 0 {
+			return fmt.Errorf("onion port %s is used by onioncat", OnionCatPort)
+		}
+
+		torService.Targets = append(GenerateTargetMappings(addr, portMappings), onionCatTargets...)
+		log.WithFields(log.Fields{
+			"dir":   torService.Dir,
+			"ports": formatPorts(portMappings),
+		}).Info("updated onion service ports")
+	}
+
+	// Adding a service means Tor has to generate a new key.
+	for _, update := range options.Services {
+		if _, ok := updates[path.Join(HiddenServiceDir, update.Name)]; ok {
+			return fmt.Errorf("service %s: onion service %s has no such service, adding one needs a new onion service", update.Name, svc.Ident)
+		}
+	}
+	if len(options.Mappings) > 0 && (len(services) != 1 || services[0].Dir != HiddenServiceDir) {
+		return fmt.Errorf("onion service %s has named services, use -service to change their ports", svc.Ident)
+	}
+
+	return replaceTorrc(cli, svc.ContainerID, oldTorrc, services, torOptions)
+}
+
+// replaceTorrc generates a new torrc, copies it into a running Tor container
+// and reloads Tor. If the new torrc is broken, the old one is put back.
+func replaceTorrc(cli *client.Client, containerID string, oldTorrc []byte, services []TorService, options map[string]string) error {
+	torrc, err := GenerateConfig(cli, services, options)
+	if err != nil {
+		return fmt.Errorf("generating torrc: %s", err)
+	}
+
+	if err := copyTorrcToContainer(cli, containerID, torrc); err != nil {
+		return fmt.Errorf("copying torrc: %s", err)
+	}
+
+	// Tor ignores an invalid torrc when reloading, which would leave the old
+	// configuration running without telling anyone. So check it ourselves,
+	// and put the old torrc back if it's broken.
+	if err := execInContainer(cli, containerID, verifyConfigCommand(services)); err != nil {
+		if err := copyTorrcToContainer(cli, containerID, oldTorrc); err != nil {
+			log.Warnf("restoring old torrc: %s", err)
+		}
+		return fmt.Errorf("verifying new torrc: %s", err)
+	}
+
+	if err := reloadTor(cli, containerID); err != nil {
+		return fmt.Errorf("reloading tor: %s", err)
+	}
+	return nil
+}
+
+// readTorrcPorts replaces the port mappings in the labels of an onion service
+// with the ones in the torrc of its Tor container, since `mkonion update`
+// changes the torrc but can't change the labels. It returns whether they
+// differ from the ones the onion service was created with.
+func readTorrcPorts(cli *client.Client, containerID string, labels *ServiceLabels) (bool, error) {
+	torrc, err := readContainerFile(cli, containerID, TorrcPath)
+	if err != nil {
+		return false, err
+	}
+	services, _, err := ParseConfig(torrc)
+	if err != nil {
+		return false, err
+	}
+
+	var updated bool
+	for _, torService := range services {
+		ports := map[string]string{}
+		for _, target := range torService.Targets {
+			if !isOnionCatTarget(labels, target) {
+				ports[target.ExternalPort] = target.InternalPort
+			}
+		}
+
+		if torService.Dir == HiddenServiceDir {
+			updated = updated || !reflect.DeepEqual(labels.Ports, ports)
+			labels.Ports = ports
+		} else if svcLabels, ok := labels.Services[path.Base(torService.Dir)]; ok {
+			updated = updated || !reflect.DeepEqual(svcLabels.Ports, ports)
+			svcLabels.Ports = ports
+		}
+	}
+	return updated, nil
+}
+
+func cmdUpdate(args []string) error {
+	var (
+		oMappings *flagList    = new(flagList)
+		oServices *serviceList = new(serviceList)
+	)
+
+	flags := newFlagSet("update", "[-p [onion:]container]... [-service name=NAME,port=[onion:]container]... <ident|target>")
+	flags.Var(oMappings, "p", "specify the new list of port mappings of the form '[onion:]container'")
+	flags.Var(oServices, "service", "specify the new ports of a named service of the form 'name=NAME,port=[onion:]container[,port=...]' (can be repeated)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("must specify an onion service to update")
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	svc, err := findSingleService(cli, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := UpdateOnionService(cli, svc, &UpdateOptions{
+		Mappings: *oMappings,
+		Services: *oServices,
+	}); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"ident": svc.Ident,
+	}).Info("updated onion service")
+	return nil
+}
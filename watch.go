@@ -0,0 +1,294 @@
+// mkonion: create a Tor onion service for existing Docker containers
+// Copyright (C) 2016 Aleksa Sarai <cyphar@cyphar.com>
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+	"github.com/docker/engine-api/types/filters"
+)
+
+// The address of the target is baked into the torrc when an onion service is
+// created. If the target is restarted it might get a new address on the onion
+// network, and if it is recreated it isn't connected to the onion network at
+// all. `mkonion watch` follows the Docker event stream and fixes up onion
+// services whenever one of their targets is started. Targets are matched by
+// name, since a recreated target has a new ID.
+
+// RefreshOnionService makes sure the target of an onion service is connected to
+// its onion network, and that Tor is forwarding to the current address of the
+// target. Targets which don't exist or aren't running are left alone.
+func RefreshOnionService(cli *client.Client, ident string, labels *ServiceLabels) error {
+	logger := log.WithFields(log.Fields{
+		"ident":  ident,
+		"target": labels.TargetRef(),
+	})
+
+	target, err := cli.ContainerInspect(labels.TargetRef())
+	if err != nil {
+		if client.IsErrContainerNotFound(err) {
+			logger.Debug("watch: target doesn't exist")
+			return nil
+		}
+		return fmt.Errorf("inspecting target: %s", err)
+	}
+	if !isRunning(target.State) {
+		return nil
+	}
+
+	// Targets on a reused network are resolved by name, so they don't need an
+	// alias.
+	network, alias := labels.NetworkName(), targetAlias(ident)
+	if labels.Network != "" {
+		alias = ""
+	}
+	if target.NetworkSettings == nil || target.NetworkSettings.Networks[network] == nil {
+		logger.WithField("container", target.ID).Info("watch: connecting target to onion network")
+		if err := ConnectOnionNetwork(cli, target.ID, network, alias); err != nil {
+			return fmt.Errorf("connecting target: %s", err)
+		}
+	}
+
+	ip, err := FindOnionIPAddress(cli, target.ID, network)
+	if err != nil {
+		return fmt.Errorf("finding target onion ip: %s", err)
+	}
+
+	// The torrc of the shared daemon is generated from the current state of
+	// every target, and is only reloaded if it has changed.
+	if labels.Daemon != "" {
+		return ReloadSharedDaemon(cli)
+	}
+
+	// XXX: Tor doesn't tell us where an ephemeral onion service forwards to,
+	//      and it has discarded the key so we can't add it again.
+	if labels.Ephemeral {
+		logger.Warn("watch: ephemeral onion services can't follow their target, it might have to be recreated")
+		return nil
+	}
+
+	inspect, err := cli.ContainerInspect(ident)
+	if err != nil {
+		if client.IsErrContainerNotFound(err) {
+			logger.Warn("watch: onion service has no tor container")
+			return nil
+		}
+		return err
+	}
+	if !isRunning(inspect.State) {
+		return nil
+	}
+
+	oldTorrc, err := readContainerFile(cli, inspect.ID, TorrcPath)
+	if err != nil {
+		return fmt.Errorf("reading torrc: %s", err)
+	}
+	services, torOptions, err := ParseConfig(oldTorrc)
+	if err != nil {
+		return fmt.Errorf("parsing torrc: %s", err)
+	}
+
+	// Routes and firewall rules are lost when a container restarts, so set
+	// them up again.
+	if labels.Isolate {
+		// A recreated target is probably back on its old networks.
+		networks, err := isolatedNetworks(target)
+		if err != nil {
+			return err
+		}
+		var others []string
+		for _, name := range networks {
+			if name != ident {
+				others = append(others, name)
+			}
+		}
+		if err := DisconnectTarget(cli, nil, target, others); err != nil {
+			return err
+		}
+
+		logger.Info("watch: routing target through tor")
+		if err := SetupTransparentProxy(cli, inspect.Image, inspect.ID, ident); err != nil {
+			return fmt.Errorf("setting up transparent proxy: %s", err)
+		}
+		if err := RouteThroughTor(cli, inspect.Image, target.ID, inspect.ID, ident); err != nil {
+			return fmt.Errorf("routing target through tor: %s", err)
+		}
+		if err := CheckIsolation(cli, inspect.Image, target.ID, inspect.ID, ident); err != nil {
+			return err
+		}
+	}
+
+	// The address of an alias is only resolved when Tor is reloaded, so
+	// reload it whenever the target starts.
+	if usesAliases(services) {
+		logger.Info("watch: reloading tor to resolve target alias")
+		return reloadTor(cli, inspect.ID)
+	}
+
+	// OnionCat might have been restarted too.
+	onionCatIP := ""
+	if labels.OnionCat != "" {
+		onionCatIP, err = FindOnionIPAddress(cli, labels.OnionCat, network)
+		if err != nil {
+			logger.Warnf("watch: finding onioncat onion ip: %s", err)
+		}
+	}
+
+	changed := false
+	for i := range services {
+		for j := range services[i].Targets {
+			addr := ip
+			if isOnionCatTarget(labels, services[i].Targets[j]) {
+				if onionCatIP == "" {
+					continue
+				}
+				addr = onionCatIP
+			}
+			if services[i].Targets[j].Addr != addr {
+				services[i].Targets[j].Addr = addr
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	logger.WithField("ip", ip).Info("watch: target address changed, rewriting torrc")
+	return replaceTorrc(cli, inspect.ID, oldTorrc, services, torOptions)
+}
+
+// refreshTargets refreshes every onion service of the target with the given
+// name, or every onion service if name is empty. Errors are logged rather than
+// returned, so that one broken service doesn't stop the others being fixed.
+func refreshTargets(cli *client.Client, name string) error {
+	networks, err := listOnionNetworks(cli)
+	if err != nil {
+		return fmt.Errorf("finding onion networks: %s", err)
+	}
+
+	// Services created by older versions of mkonion don't record their
+	// target, so there's nothing we can do for them.
+	all := map[string]*ServiceLabels{}
+	for _, network := range networks {
+		if labels, err := ParseServiceLabels(network.Options); err == nil {
+			all[network.Name] = labels
+			continue
+		}
+		// Only bridge networks are labelled, so fall back to the labels of
+		// the Tor container.
+		if inspect, err := cli.ContainerInspect(network.Name); err == nil && inspect.Config != nil {
+			if labels, err := ParseServiceLabels(inspect.Config.Labels); err == nil {
+				all[network.Name] = labels
+			}
+		}
+	}
+
+	// Services on a reused network are only labelled on their Tor container.
+	containers, err := listReusedServices(cli)
+	if err != nil {
+		return fmt.Errorf("finding onion services: %s", err)
+	}
+	for _, container := range containers {
+		if labels, err := ParseServiceLabels(container.Labels); err == nil {
+			all[containerName(container)] = labels
+		}
+	}
+
+	var idents []string
+	for ident := range all {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+
+	for _, ident := range idents {
+		labels := all[ident]
+		// The Tor container of an isolated target has to be set up again
+		// when it restarts too, and Tor has to follow OnionCat.
+		if name != "" && labels.TargetName != name && !(labels.Isolate && ident == name) && !(labels.OnionCat != "" && labels.OnionCat == name) {
+			continue
+		}
+
+		if err := RefreshOnionService(cli, ident, labels); err != nil {
+			log.Errorf("watch: refreshing %s: %s", ident, err)
+		}
+	}
+	return nil
+}
+
+// Watch follows the Docker event stream, refreshing the onion services of
+// every target that is started. It only returns if the event stream fails.
+func Watch(cli *client.Client) error {
+	args := filters.NewArgs()
+	args.Add("type", events.ContainerEventType)
+	args.Add("event", "start")
+
+	// Subscribe before catching up, so that nothing started in between is
+	// missed.
+	stream, err := cli.Events(types.EventsOptions{
+		Filters: args,
+	})
+	if err != nil {
+		return fmt.Errorf("subscribing to events: %s", err)
+	}
+	defer stream.Close()
+
+	// Fix up anything that happened while we weren't watching.
+	if err := refreshTargets(cli, ""); err != nil {
+		return err
+	}
+	log.Info("watch: watching for target containers")
+
+	decoder := json.NewDecoder(stream)
+	for {
+		var msg events.Message
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("event stream closed")
+			}
+			return fmt.Errorf("reading events: %s", err)
+		}
+
+		name := msg.Actor.Attributes["name"]
+		if name == "" {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"container": msg.Actor.ID,
+			"name":      name,
+		}).Debug("watch: container started")
+		if err := refreshTargets(cli, name); err != nil {
+			log.Errorf("watch: %s", err)
+		}
+	}
+}
+
+func cmdWatch(args []string) error {
+	flags := newFlagSet("watch", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return fmt.Errorf("watch takes no arguments")
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return fmt.Errorf("connecting to client: %s", err)
+	}
+
+	return Watch(cli)
+}